@@ -2,58 +2,160 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/accept-nano/accept-nano/internal/nano"
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/internal/units"
 	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
 )
 
 const adminName = "admin"
 
-func handleAdminGetActivePayments(w http.ResponseWriter, r *http.Request) {
+// nodeErrorStatus returns the HTTP status for errors of operations that make node requests.
+func nodeErrorStatus(err error) int {
+	var timeoutErr *nano.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return http.StatusGatewayTimeout
+	}
+	if err == errNotLeader {
+		return http.StatusServiceUnavailable
+	}
+	if err == store.ErrConflict {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// requireLeader writes an error response if this instance is not the leader.
+// Handlers that move funds only run on the leader so that a payment is not processed by two instances at the same time.
+func requireLeader(w http.ResponseWriter) bool {
+	if isLeader() {
+		return true
+	}
+	http.Error(w, errNotLeader.Error(), http.StatusServiceUnavailable)
+	return false
+}
+
+// checkAdminAuth validates HTTP basic auth credentials and writes an error response if they are not valid.
+func checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
 	username, password, ok := r.BasicAuth()
 	if !ok {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
+		return false
 	}
 	if username != adminName {
 		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
+		return false
 	}
 	if password != config.AdminPassword {
 		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
+		return false
 	}
-	payments, err := LoadActivePayments()
+	return true
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payments, "", "  ")
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
+func handleAdminGetActivePayments(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	payments, err := LoadActivePayments()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = w.Write(b)
-	if err != nil {
-		log.Debug(err)
+	orderID := r.FormValue("order_id")
+	state := r.FormValue("state")
+	if orderID != "" || state != "" {
+		filtered := make([]*Payment, 0)
+		for _, p := range payments {
+			if (orderID == "" || p.OrderID == orderID) && (state == "" || p.State == state) {
+				filtered = append(filtered, p)
+			}
+		}
+		payments = filtered
 	}
+	writeAdminJSON(w, payments)
 }
 
 func handleAdminGetPayment(w http.ResponseWriter, r *http.Request) {
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	orderID := r.FormValue("order_id")
+	state := r.FormValue("state")
+	if orderID != "" || state != "" {
+		var payments []*Payment
+		var err error
+		if orderID != "" {
+			payments, err = LoadPaymentsByOrderID(orderID)
+			if err == nil && state != "" {
+				filtered := make([]*Payment, 0, len(payments))
+				for _, p := range payments {
+					if p.State == state {
+						filtered = append(filtered, p)
+					}
+				}
+				payments = filtered
+			}
+		} else {
+			payments, err = LoadPaymentsByState(state)
+		}
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, payments)
 		return
 	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	account := r.FormValue("account")
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	payment, err := LoadPayment(account)
+	if err == errPaymentNotFound {
+		log.Debugln("account not found:", account)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, payment)
+}
+
+func handleAdminCheckPayment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	if !requireLeader(w) {
 		return
 	}
 	account := r.FormValue("account")
@@ -61,6 +163,8 @@ func handleAdminGetPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
 	}
+	locks.Lock(account)
+	defer locks.Unlock(account)
 	payment, err := LoadPayment(account)
 	if err == errPaymentNotFound {
 		log.Debugln("account not found:", account)
@@ -72,34 +176,31 @@ func handleAdminGetPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
+	err = payment.check(r.Context())
 	if err != nil {
 		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), nodeErrorStatus(err))
 		return
 	}
-	_, err = w.Write(b)
+	payment.LastCheckedAt = now()
+	err = payment.Save()
 	if err != nil {
-		log.Debug(err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	writeAdminJSON(w, payment)
 }
 
-func handleAdminCheckPayment(w http.ResponseWriter, r *http.Request) {
+func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	if !checkAdminAuth(w, r) {
 		return
 	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		return
-	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if !requireLeader(w) {
 		return
 	}
 	account := r.FormValue("account")
@@ -120,47 +221,58 @@ func handleAdminCheckPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = payment.check()
+	if payment.Status != StatusReceived && !payment.Status.canTransition(StatusReceived) {
+		http.Error(w, "cannot receive funds of "+string(payment.Status)+" payment", http.StatusConflict)
+		return
+	}
+	payment.ReceivedAt = nil
+	err = payment.Save()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	payment.LastCheckedAt = now()
-	err = payment.Save()
+	err = payment.receivePending(r.Context())
 	if err != nil {
 		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), nodeErrorStatus(err))
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
+	// Event is published only once, when the payment moves to the next status.
+	publish := payment.Status != StatusReceived
+	err = payment.setStatus(StatusReceived)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = w.Write(b)
+	payment.ReceivedAt = now()
+	if publish {
+		err = payment.publishEvent(EventReceived)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = payment.Save()
 	if err != nil {
-		log.Debug(err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	writeAdminJSON(w, payment)
 }
 
-func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
+func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if !checkAdminAuth(w, r) {
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if !requireLeader(w) {
 		return
 	}
 	account := r.FormValue("account")
@@ -181,54 +293,114 @@ func handleAdminReceivePending(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	payment.ReceivedAt = nil
+	if payment.Status != StatusSettled && !payment.Status.canTransition(StatusSettled) {
+		http.Error(w, "cannot send funds of "+string(payment.Status)+" payment", http.StatusConflict)
+		return
+	}
+	payment.SentAt = nil
 	err = payment.Save()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = payment.receivePending()
+	err = payment.sendToMerchant(r.Context())
+	if err == nano.ErrAccountNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), nodeErrorStatus(err))
+		return
+	}
+	// Event is published only once, when the payment moves to the next status.
+	publish := payment.Status != StatusSettled
+	err = payment.setStatus(StatusSettled)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	payment.ReceivedAt = now()
+	payment.SentAt = now()
+	if publish {
+		err = payment.publishEvent(EventSent)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	err = payment.Save()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
+	writeAdminJSON(w, payment)
+}
+
+func handleAdminGetDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	deliveries, err := LoadDeliveries(false)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = w.Write(b)
+	writeAdminJSON(w, deliveries)
+}
+
+func handleAdminGetDeadDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	deliveries, err := LoadDeliveries(true)
 	if err != nil {
-		log.Debug(err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	writeAdminJSON(w, deliveries)
 }
 
-func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
+func handleAdminReplayDelivery(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "POST only", http.StatusMethodNotAllowed)
 		return
 	}
-	username, password, ok := r.BasicAuth()
-	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	if !checkAdminAuth(w, r) {
 		return
 	}
-	if username != adminName {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "invalid id", http.StatusBadRequest)
 		return
 	}
-	if password != config.AdminPassword {
-		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	delivery, err := ReplayDeadDelivery(id)
+	if err == errDeliveryNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, delivery)
+}
+
+func handleAdminRefund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	if !requireLeader(w) {
 		return
 	}
 	account := r.FormValue("account")
@@ -236,29 +408,77 @@ func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid account", http.StatusBadRequest)
 		return
 	}
-	locks.Lock(account)
-	defer locks.Unlock(account)
-	payment, err := LoadPayment(account)
+	var amount decimal.Decimal
+	if s := r.FormValue("amount"); s != "" {
+		var err error
+		amount, err = decimal.NewFromString(s)
+		if err != nil || !amount.IsPositive() {
+			http.Error(w, "invalid amount", http.StatusBadRequest)
+			return
+		}
+	}
+	payment, err := RefundPayment(r.Context(), account, units.NanoToRaw(amount))
 	if err == errPaymentNotFound {
 		log.Debugln("account not found:", account)
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	if err == errInsufficientBalance || err == errRefundExceedsPayments || err == errRefundForwarded || err == errRefundNotAllowed {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), nodeErrorStatus(err))
+		return
+	}
+	writeAdminJSON(w, payment)
+}
+
+func handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	account := r.FormValue("account")
+	if account == "" {
+		http.Error(w, "invalid account", http.StatusBadRequest)
+		return
+	}
+	payment, err := CancelPayment(account)
+	if err == errPaymentNotFound {
+		log.Debugln("account not found:", account)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err == errPaymentNotCancellable || err == store.ErrConflict {
+		// Payment may be updated by the leader instance at the same time.
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-	payment.SentAt = nil
-	err = payment.Save()
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = payment.sendToMerchant()
-	if err == nano.ErrAccountNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	writeAdminJSON(w, payment)
+}
+
+func handleAdminGetPayments(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	q, err := parsePaymentQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := QueryPayments(q)
+	if err == errInvalidCursor {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	if err != nil {
@@ -266,21 +486,152 @@ func handleAdminSendToMerchant(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	payment.SentAt = now()
-	err = payment.Save()
+	writeAdminJSON(w, page)
+}
+
+func handleAdminNodeStatus(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	writeAdminJSON(w, node.Status())
+}
+
+func handleAdminGetSettlements(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	var before uint64
+	if s := r.FormValue("before"); s != "" {
+		var err error
+		before, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultQueryLimit
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxQueryLimit {
+			limit = maxQueryLimit
+		}
+	}
+	settlements, err := LoadSettlements(before, limit)
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	b, err := json.MarshalIndent(&payment, "", "  ")
+	writeAdminJSON(w, settlements)
+}
+
+func handleAdminGetSettlement(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	settlement, err := LoadSettlement(id)
+	if err == errSettlementNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = w.Write(b)
+	writeAdminJSON(w, settlement)
+}
+
+func handleAdminExportPayments(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	format := r.FormValue("format")
+	if format == "" {
+		format = exportFormatCSV
+	}
+	if !validExportFormat(format) {
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	q, err := parsePaymentQuery(r)
 	if err != nil {
-		log.Debug(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	if format == exportFormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=payments."+format)
+	err = ExportPayments(w, format, q)
+	if err != nil {
+		// Response may already be partially written, nothing to do other than logging.
+		log.Errorln("cannot export payments:", err)
+	}
+}
+
+// parsePaymentQuery parses query parameters of payment listing endpoints.
+// Dates are in RFC3339 format and amounts are in NANO.
+func parsePaymentQuery(r *http.Request) (q PaymentQuery, err error) {
+	if s := r.FormValue("status"); s != "" {
+		for _, status := range strings.Split(s, ",") {
+			q.Statuses = append(q.Statuses, Status(status))
+		}
+	}
+	if s := r.FormValue("from"); s != "" {
+		q.CreatedFrom, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, errors.New("invalid from")
+		}
+	}
+	if s := r.FormValue("to"); s != "" {
+		q.CreatedTo, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, errors.New("invalid to")
+		}
+	}
+	q.Currency = strings.ToUpper(r.FormValue("currency"))
+	if s := r.FormValue("min_amount"); s != "" {
+		amount, err2 := decimal.NewFromString(s)
+		if err2 != nil {
+			return q, errors.New("invalid min_amount")
+		}
+		amount = units.NanoToRaw(amount)
+		q.MinAmount = &amount
+	}
+	if s := r.FormValue("max_amount"); s != "" {
+		amount, err2 := decimal.NewFromString(s)
+		if err2 != nil {
+			return q, errors.New("invalid max_amount")
+		}
+		amount = units.NanoToRaw(amount)
+		q.MaxAmount = &amount
+	}
+	switch r.FormValue("sort") {
+	case "", "desc":
+		q.Descending = true
+	case "asc":
+	default:
+		return q, errors.New("invalid sort")
+	}
+	if s := r.FormValue("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			return q, errors.New("invalid limit")
+		}
+	}
+	q.Cursor = r.FormValue("cursor")
+	return q, nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/cenkalti/log"
+)
+
+// ArchivedPayment is a line in archive files.
+type ArchivedPayment struct {
+	Account string          `json:"account"`
+	Payment json.RawMessage `json:"payment"`
+}
+
+// archivable returns true if no more operations are expected on the payment.
+// Late paid payments are kept because they wait for the merchant's action.
+func (p *Payment) archivable() bool {
+	switch p.Status {
+	case StatusSettled, StatusExpired, StatusCancelled:
+		return true
+	}
+	return false
+}
+
+// runArchiver archives old payments periodically until stop is closed.
+func runArchiver(stop chan struct{}) {
+	defer workersWG.Done()
+	for {
+		count, err := archivePayments(stop)
+		if err != nil {
+			log.Errorln("cannot archive payments:", err)
+		} else if count > 0 {
+			log.Noticef("archived %d payments", count)
+		}
+		select {
+		case <-time.After(config.ArchiveInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// archivePayments archives finished payments created before ArchiveAfter and returns the number of archived payments.
+// Payments are moved to the archive in the store, or written to a file in ArchiveDir and deleted if ArchiveDir is set.
+func archivePayments(stop chan struct{}) (int, error) {
+	var accounts []string
+	opts := store.ListOptions{CreatedTo: time.Now().Add(-config.ArchiveAfter)}
+	err := paymentStore.List(opts, func(r *store.Record) (bool, error) {
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			log.Errorf("cannot decode payment %s: %s", r.Account, err)
+			return true, nil
+		}
+		if p.archivable() {
+			accounts = append(accounts, r.Account)
+		}
+		return true, nil
+	})
+	if err != nil || len(accounts) == 0 {
+		return 0, err
+	}
+	if config.ArchiveDir != "" {
+		return archivePaymentsToFile(stop, accounts)
+	}
+	count := 0
+	for _, account := range accounts {
+		select {
+		case <-stop:
+			return count, nil
+		default:
+		}
+		ok, err := withArchivablePayment(account, func(account string) error { return paymentStore.Archive(account, true) })
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// archivePaymentsToFile writes the payments to a new compressed JSON lines file in ArchiveDir and removes their data from the store.
+// Accounts are kept in the archive of the store so that they cannot be used for new payments.
+// Payments are removed only after the file is synced to disk.
+// If removing fails, remaining payments are written to another file in the next run.
+func archivePaymentsToFile(stop chan struct{}, accounts []string) (int, error) {
+	err := os.MkdirAll(config.ArchiveDir, 0700)
+	if err != nil {
+		return 0, err
+	}
+	path := filepath.Join(config.ArchiveDir, "payments-"+time.Now().UTC().Format(backupFileTimeFormat)+".jsonl.gz")
+	tmpPath := path + ".tmp"
+	var archived []string
+	err = writeFile(tmpPath, func(w io.Writer) error {
+		gz := gzip.NewWriter(w)
+		enc := json.NewEncoder(gz)
+		for _, account := range accounts {
+			r, err := paymentStore.Get(account)
+			if err == store.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = enc.Encode(ArchivedPayment{Account: account, Payment: r.Data})
+			if err != nil {
+				return err
+			}
+			archived = append(archived, account)
+		}
+		return gz.Close()
+	})
+	if err != nil {
+		os.Remove(tmpPath) // nolint:errcheck
+		return 0, err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("archived %d payments to %s", len(archived), path)
+	count := 0
+	for _, account := range archived {
+		select {
+		case <-stop:
+			return count, nil
+		default:
+		}
+		ok, err := withArchivablePayment(account, func(account string) error { return paymentStore.Archive(account, false) })
+		if err != nil {
+			return count, err
+		}
+		if ok {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// withArchivablePayment locks and reloads the payment and calls fn if the payment is still archivable.
+// Returns true if fn is called.
+func withArchivablePayment(account string, fn func(account string) error) (bool, error) {
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err := LoadPayment(account)
+	if err == errPaymentNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !p.archivable() {
+		return false, nil
+	}
+	return true, fn(account)
+}
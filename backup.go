@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	backupFilePrefix     = "accept-nano-"
+	backupFileSuffix     = ".db"
+	backupFileTimeFormat = "20060102T150405Z"
+)
+
+// writeBackup writes a consistent snapshot of the database to w.
+func writeBackup(w io.Writer) (n int64, err error) {
+	err = db.View(func(tx *bbolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return
+}
+
+func backupFileName(t time.Time) string {
+	return backupFilePrefix + t.UTC().Format(backupFileTimeFormat) + backupFileSuffix
+}
+
+// handleAdminBackup downloads a snapshot of the local database.
+// Payments are not in the local database with postgres backend, so it must be backed up with PostgreSQL tools instead.
+func handleAdminBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminAuth(w, r) {
+		return
+	}
+	if config.DatabaseBackend == "postgres" {
+		http.Error(w, "payments are saved in postgres, back up the database with pg_dump", http.StatusNotImplemented)
+		return
+	}
+	err := db.View(func(tx *bbolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename="+backupFileName(time.Now()))
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		// Response may already be partially written, nothing to do other than logging.
+		log.Errorln("cannot write backup:", err)
+	}
+}
+
+// runBackupScheduler saves backups to BackupDir periodically.
+func runBackupScheduler() {
+	defer workersWG.Done()
+	for {
+		select {
+		case <-time.After(config.BackupInterval):
+			path, err := saveBackup(config.BackupDir)
+			if err != nil {
+				log.Errorln("cannot save backup:", err)
+				continue
+			}
+			log.Infoln("database is backed up to", path)
+			err = rotateBackups(config.BackupDir, config.BackupKeep)
+			if err != nil {
+				log.Errorln("cannot delete old backups:", err)
+			}
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+// saveBackup writes a snapshot of the database to a new file in dir and returns the path of the file.
+// The file is written under a temporary name first so that an incomplete backup is never mistaken for a valid one.
+func saveBackup(dir string) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, backupFileName(time.Now()))
+	tmpPath := path + ".tmp"
+	err = writeFile(tmpPath, func(w io.Writer) error {
+		_, err2 := writeBackup(w)
+		return err2
+	})
+	if err != nil {
+		os.Remove(tmpPath) // nolint:errcheck
+		return "", err
+	}
+	return path, os.Rename(tmpPath, path)
+}
+
+// writeFile creates the file at path and syncs it to disk after fn writes its content.
+func writeFile(path string, fn func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if err != nil {
+		f.Close() // nolint:errcheck
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close() // nolint:errcheck
+		return err
+	}
+	return f.Close()
+}
+
+// rotateBackups deletes the oldest backups in dir, keeping the newest keep files.
+func rotateBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+	// Names contain the backup time so they are sorted from oldest to newest.
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		log.Debugln("deleted old backup:", name)
+	}
+	return nil
+}
+
+// validateBackup checks the integrity of the database file at path and decodes all of the payments in it.
+// Returns the number of payments in the backup.
+func validateBackup(path string) (int, error) {
+	backup, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: dbLockTimeout})
+	if err != nil {
+		return 0, err
+	}
+	defer backup.Close()
+	count := 0
+	err = backup.View(func(tx *bbolt.Tx) error {
+		// Check sends all errors found to the channel. It must be drained before the transaction is closed.
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+		b := tx.Bucket([]byte(store.BoltPaymentsBucket))
+		if b == nil {
+			if config.DatabaseBackend == "postgres" {
+				// Payments are not kept in the local database.
+				return nil
+			}
+			return errors.New("payments bucket not found")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if _, err := decodePayment(string(k), v); err != nil {
+				return fmt.Errorf("invalid payment %s: %w", k, err)
+			}
+			count++
+			return nil
+		})
+	})
+	return count, err
+}
+
+// restoreBackup replaces the database file with the backup at path after validating it.
+// Current database is kept next to the database file with a ".before-restore" suffix.
+// It must be called before the database is opened. Current database is not required to be valid.
+func restoreBackup(path string) error {
+	count, err := validateBackup(path)
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+	exists, err := checkDatabaseNotInUse(config.DatabasePath)
+	if err != nil {
+		return err
+	}
+	tmpPath := config.DatabasePath + ".restore.tmp"
+	err = writeFile(tmpPath, func(w io.Writer) error {
+		f, err2 := os.Open(path)
+		if err2 != nil {
+			return err2
+		}
+		defer f.Close()
+		_, err2 = io.Copy(w, f)
+		return err2
+	})
+	if err != nil {
+		os.Remove(tmpPath) // nolint:errcheck
+		return err
+	}
+	if !exists {
+		err = os.Rename(tmpPath, config.DatabasePath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %d payments from %s\n", count, path)
+		return nil
+	}
+	oldPath := config.DatabasePath + ".before-restore." + time.Now().UTC().Format(backupFileTimeFormat)
+	err = os.Rename(config.DatabasePath, oldPath)
+	if err != nil {
+		os.Remove(tmpPath) // nolint:errcheck
+		return err
+	}
+	err = os.Rename(tmpPath, config.DatabasePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d payments from %s\nprevious database is moved to %s\n", count, path, oldPath)
+	return nil
+}
+
+// checkDatabaseNotInUse returns an error if the database file at path is locked by a running server.
+// Returns false if the file does not exist. Files that cannot be opened as a database are not considered in use.
+func checkDatabaseNotInUse(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	current, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: dbLockTimeout})
+	if err == bbolt.ErrTimeout {
+		return true, errors.New("database is in use, stop the server before restoring")
+	}
+	if err != nil {
+		log.Warningln("current database cannot be opened, it is going to be replaced:", err)
+		return true, nil
+	}
+	return true, current.Close()
+}
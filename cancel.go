@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+)
+
+var errPaymentNotCancellable = errors.New("payment cannot be cancelled")
+
+// CancelPayment cancels the payment with the given account and stops checking it.
+// Only payments that are not fulfilled yet can be cancelled.
+func CancelPayment(account string) (*Payment, error) {
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment(account)
+	if err != nil {
+		return nil, err
+	}
+	if !payment.Status.canTransition(StatusCancelled) {
+		return nil, errPaymentNotCancellable
+	}
+	err = payment.setStatus(StatusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	payment.CancelledAt = now()
+	err = payment.publishEvent(EventCancelled)
+	if err != nil {
+		return nil, err
+	}
+	err = payment.Save()
+	if err != nil {
+		return nil, err
+	}
+	stopChecking(account)
+	go verifications.Publish(PaymentVerified{Payment: *payment})
+	return payment, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	refundAccount = flag.String("refund", "", "refund the payment with given account to the customers and exit")
+	refundAmount  = flag.String("refund-amount", "", "amount in NANO for -refund, all balance is refunded if empty")
+	exportFormat  = flag.String("export", "", "write payments to stdout in given format (csv or jsonl) and exit")
+	exportFrom    = flag.String("export-from", "", "export payments created at or after this time (RFC3339 or YYYY-MM-DD)")
+	exportTo      = flag.String("export-to", "", "export payments created before this time (RFC3339 or YYYY-MM-DD)")
+	restorePath   = flag.String("restore", "", "replace the database with given backup file and exit")
+	sweep         = flag.Bool("sweep", false, "send funds in finished payment accounts to the merchant account and exit")
+	sweepDryRun   = flag.Bool("sweep-dry-run", false, "report funds in finished payment accounts without sending and exit")
+)
+
+// commandMode returns true if a command is given in flags instead of running the server.
+func commandMode() bool {
+	return *refundAccount != "" || *exportFormat != "" || *restorePath != "" || *sweep || *sweepDryRun
+}
+
+// runCommand runs the command given in flags. Database must be opened before calling this function.
+func runCommand() error {
+	if *exportFormat != "" {
+		return runExportCommand(*exportFormat, *exportFrom, *exportTo)
+	}
+	if *sweep || *sweepDryRun {
+		return runSweepCommand(*sweepDryRun)
+	}
+	return runRefundCommand(*refundAccount, *refundAmount)
+}
+
+func runSweepCommand(dryRun bool) error {
+	if !dryRun {
+		release, err := acquireCommandLease()
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	report, err := sweepDepositAccounts(nil, dryRun, 0)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	if report.Errors > 0 {
+		return fmt.Errorf("%d accounts could not be swept", report.Errors)
+	}
+	return nil
+}
+
+func runRefundCommand(account, amountString string) error {
+	var amount decimal.Decimal
+	if amountString != "" {
+		var err error
+		amount, err = decimal.NewFromString(amountString)
+		if err != nil {
+			return err
+		}
+	}
+	release, err := acquireCommandLease()
+	if err != nil {
+		return err
+	}
+	defer release()
+	payment, err := RefundPayment(shutdownCtx, account, units.NanoToRaw(amount))
+	if payment != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err2 := enc.Encode(payment); err2 != nil {
+			return err2
+		}
+	}
+	return err
+}
+
+func runExportCommand(format, from, to string) error {
+	if !validExportFormat(format) {
+		return fmt.Errorf("invalid export format: %q", format)
+	}
+	var q PaymentQuery
+	var err error
+	if from != "" {
+		q.CreatedFrom, err = parseCommandTime(from)
+		if err != nil {
+			return err
+		}
+	}
+	if to != "" {
+		q.CreatedTo, err = parseCommandTime(to)
+		if err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	err = ExportPayments(w, format, q)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// parseCommandTime parses time given in RFC3339 format or as a date in UTC.
+func parseCommandTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/shopspring/decimal"
+)
+
+// Payments are read from the store in pages of this size so that read transactions are kept short.
+const exportPageSize = 1000
+
+// Export formats.
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+)
+
+// ExportRow is a single payment in an export.
+// Amounts are in NANO unless suffixed with Raw.
+type ExportRow struct {
+	Account          string             `json:"account"`
+	Index            string             `json:"index"`
+	Status           Status             `json:"status"`
+	State            string             `json:"state"`
+	OrderID          string             `json:"orderId"`
+	Description      string             `json:"description"`
+	Currency         string             `json:"currency"`
+	AmountInCurrency decimal.Decimal    `json:"amountInCurrency"`
+	Amount           decimal.Decimal    `json:"amount"`
+	AmountRaw        decimal.Decimal    `json:"amountRaw"`
+	Balance          decimal.Decimal    `json:"balance"`
+	BalanceRaw       decimal.Decimal    `json:"balanceRaw"`
+	Overpaid         decimal.Decimal    `json:"overpaid"`
+	OverpaidRaw      decimal.Decimal    `json:"overpaidRaw"`
+	SubPayments      []ExportSubPayment `json:"subPayments"`
+	CreatedAt        time.Time          `json:"createdAt"`
+	FulfilledAt      *time.Time         `json:"fulfilledAt"`
+	NotifiedAt       *time.Time         `json:"notifiedAt"`
+	ReceivedAt       *time.Time         `json:"receivedAt"`
+	SentAt           *time.Time         `json:"sentAt"`
+	ExpiredAt        *time.Time         `json:"expiredAt"`
+	CancelledAt      *time.Time         `json:"cancelledAt"`
+	LatePaidAt       *time.Time         `json:"latePaidAt"`
+}
+
+// ExportSubPayment is a single block sent to the payment account by a customer.
+type ExportSubPayment struct {
+	Hash      string          `json:"hash"`
+	Account   string          `json:"account"`
+	Amount    decimal.Decimal `json:"amount"`
+	AmountRaw decimal.Decimal `json:"amountRaw"`
+}
+
+var exportCSVHeader = []string{
+	"account",
+	"index",
+	"status",
+	"state",
+	"order_id",
+	"description",
+	"currency",
+	"amount_in_currency",
+	"amount",
+	"amount_raw",
+	"balance",
+	"balance_raw",
+	"overpaid",
+	"overpaid_raw",
+	"senders",
+	"sub_payment_hashes",
+	"sub_payment_amounts",
+	"created_at",
+	"fulfilled_at",
+	"notified_at",
+	"received_at",
+	"sent_at",
+	"expired_at",
+	"cancelled_at",
+	"late_paid_at",
+}
+
+func newExportRow(p *Payment) *ExportRow {
+	hashes := make([]string, 0, len(p.SubPayments))
+	for hash := range p.SubPayments {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	subPayments := make([]ExportSubPayment, 0, len(hashes))
+	for _, hash := range hashes {
+		sp := p.SubPayments[hash]
+		subPayments = append(subPayments, ExportSubPayment{
+			Hash:      hash,
+			Account:   sp.Account,
+			Amount:    units.RawToNano(sp.Amount),
+			AmountRaw: sp.Amount,
+		})
+	}
+	return &ExportRow{
+		Account:          p.account,
+		Index:            p.Index,
+		Status:           p.Status,
+		State:            p.State,
+		OrderID:          p.OrderID,
+		Description:      p.Description,
+		Currency:         p.Currency,
+		AmountInCurrency: p.AmountInCurrency,
+		Amount:           units.RawToNano(p.Amount),
+		AmountRaw:        p.Amount,
+		Balance:          units.RawToNano(p.Balance),
+		BalanceRaw:       p.Balance,
+		Overpaid:         units.RawToNano(p.Overpaid),
+		OverpaidRaw:      p.Overpaid,
+		SubPayments:      subPayments,
+		CreatedAt:        p.CreatedAt,
+		FulfilledAt:      p.FulfilledAt,
+		NotifiedAt:       p.NotifiedAt,
+		ReceivedAt:       p.ReceivedAt,
+		SentAt:           p.SentAt,
+		ExpiredAt:        p.ExpiredAt,
+		CancelledAt:      p.CancelledAt,
+		LatePaidAt:       p.LatePaidAt,
+	}
+}
+
+// csvRecord returns the row as CSV fields in the order of exportCSVHeader.
+// Sub-payment fields contain values separated by semicolons.
+// Text fields supplied by merchants and customers are escaped so that spreadsheets do not evaluate them as formulas.
+func (r *ExportRow) csvRecord() []string {
+	senders := make([]string, len(r.SubPayments))
+	hashes := make([]string, len(r.SubPayments))
+	amounts := make([]string, len(r.SubPayments))
+	for i, sp := range r.SubPayments {
+		senders[i] = sp.Account
+		hashes[i] = sp.Hash
+		amounts[i] = sp.Amount.String()
+	}
+	return []string{
+		r.Account,
+		r.Index,
+		string(r.Status),
+		escapeCSVFormula(r.State),
+		escapeCSVFormula(r.OrderID),
+		escapeCSVFormula(r.Description),
+		r.Currency,
+		r.AmountInCurrency.String(),
+		r.Amount.String(),
+		r.AmountRaw.String(),
+		r.Balance.String(),
+		r.BalanceRaw.String(),
+		r.Overpaid.String(),
+		r.OverpaidRaw.String(),
+		strings.Join(senders, ";"),
+		strings.Join(hashes, ";"),
+		strings.Join(amounts, ";"),
+		formatExportTime(&r.CreatedAt),
+		formatExportTime(r.FulfilledAt),
+		formatExportTime(r.NotifiedAt),
+		formatExportTime(r.ReceivedAt),
+		formatExportTime(r.SentAt),
+		formatExportTime(r.ExpiredAt),
+		formatExportTime(r.CancelledAt),
+		formatExportTime(r.LatePaidAt),
+	}
+}
+
+// escapeCSVFormula prefixes the value with a single quote if it starts with a character that spreadsheets treat as a formula.
+func escapeCSVFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// validExportFormat returns true if the format is supported by ExportPayments.
+func validExportFormat(format string) bool {
+	return format == exportFormatCSV || format == exportFormatJSONL
+}
+
+// ExportPayments writes payments matching the query to w in the given format, oldest first.
+// Sorting, Limit and Cursor fields of the query are ignored.
+// Payments are read in pages with a separate transaction for each page so that a slow writer does not keep a transaction open.
+// Archived payments are not exported.
+func ExportPayments(w io.Writer, format string, q PaymentQuery) error {
+	var write func(*ExportRow) error
+	var flush func() error
+	switch format {
+	case exportFormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			return err
+		}
+		write = func(r *ExportRow) error { return cw.Write(r.csvRecord()) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case exportFormatJSONL:
+		enc := json.NewEncoder(w)
+		write = func(r *ExportRow) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	default:
+		return fmt.Errorf("invalid export format: %q", format)
+	}
+	q.Descending = false
+	opts := q.listOptions()
+	for {
+		page := make([]*Payment, 0, exportPageSize)
+		err := paymentStore.List(opts, func(r *store.Record) (bool, error) {
+			p, err := decodePayment(r.Account, r.Data)
+			if err != nil {
+				return false, err
+			}
+			page = append(page, p)
+			return len(page) < exportPageSize, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range page {
+			if !q.match(p) {
+				continue
+			}
+			if err = write(newExportRow(p)); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return flush()
+		}
+		last := page[len(page)-1]
+		opts.After = &store.Cursor{CreatedAt: last.CreatedAt, Account: last.account}
+	}
+}
@@ -8,10 +8,11 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gorilla/websocket v1.4.2
 	github.com/knadh/koanf v0.12.1
+	github.com/lib/pq v1.10.9
 	github.com/mitchellh/mapstructure v1.2.2
 	github.com/rs/cors v1.7.0
 	github.com/shopspring/decimal v1.2.0
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/testify v1.7.0
 	github.com/ulule/limiter/v3 v3.5.0
 	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.14.0
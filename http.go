@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/accept-nano/accept-nano/internal/hub"
+	"github.com/accept-nano/accept-nano/internal/store"
 	"github.com/accept-nano/accept-nano/internal/units"
 	"github.com/cenkalti/log"
 	"github.com/rs/cors"
@@ -15,6 +20,13 @@ import (
 	"golang.org/x/net/websocket"
 )
 
+// Limits for merchant supplied fields in payment requests.
+const (
+	maxOrderIDLength     = 128
+	maxDescriptionLength = 1024
+	maxMetadataSize      = 4096
+)
+
 func runServer() {
 	ratelimitMiddleware := stdlib.NewMiddleware(rateLimiter)
 
@@ -23,17 +35,33 @@ func runServer() {
 	mux.Handle("/api/pay", ratelimitMiddleware.Handler(http.HandlerFunc(handlePay)))
 	mux.Handle("/api/price", ratelimitMiddleware.Handler(http.HandlerFunc(handlePrice)))
 	mux.HandleFunc("/api/verify", handleVerify)
+	mux.HandleFunc("/api/cancel", handleCancel)
 	mux.Handle("/websocket", websocket.Handler(handleWebsocket))
 	if config.AdminPassword != "" {
+		mux.HandleFunc("/admin/payments", handleAdminGetPayments)
+		mux.HandleFunc("/admin/payments/export", handleAdminExportPayments)
 		mux.HandleFunc("/admin/payments/active", handleAdminGetActivePayments)
 		mux.HandleFunc("/admin/payment", handleAdminGetPayment)
 		mux.HandleFunc("/admin/check", handleAdminCheckPayment)
 		mux.HandleFunc("/admin/receive", handleAdminReceivePending)
 		mux.HandleFunc("/admin/send", handleAdminSendToMerchant)
+		mux.HandleFunc("/admin/refund", handleAdminRefund)
+		mux.HandleFunc("/admin/cancel", handleAdminCancel)
+		mux.HandleFunc("/admin/deliveries", handleAdminGetDeliveries)
+		mux.HandleFunc("/admin/deliveries/dead", handleAdminGetDeadDeliveries)
+		mux.HandleFunc("/admin/deliveries/replay", handleAdminReplayDelivery)
+		mux.HandleFunc("/admin/backup", handleAdminBackup)
+		mux.HandleFunc("/admin/settlements", handleAdminGetSettlements)
+		mux.HandleFunc("/admin/settlement", handleAdminGetSettlement)
+		mux.HandleFunc("/admin/node", handleAdminNodeStatus)
 	}
 
 	server.Addr = config.ListenAddress
-	server.Handler = cors.Default().Handler(mux)
+	server.BaseContext = func(net.Listener) context.Context { return requestsCtx }
+	server.Handler = cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodHead, http.MethodGet, http.MethodPost},
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", idempotencyKeyHeader},
+	}).Handler(mux)
 
 	var err error
 	if config.CertFile != "" && config.KeyFile != "" {
@@ -86,6 +114,77 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid amount", http.StatusBadRequest)
 		return
 	}
+	var allowedDuration time.Duration
+	if s := r.FormValue("duration"); s != "" {
+		seconds, err2 := strconv.Atoi(s)
+		allowedDuration = time.Duration(seconds) * time.Second
+		if err2 != nil || allowedDuration < config.MinAllowedDuration || allowedDuration > config.MaxAllowedDuration {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	orderID := r.FormValue("orderId")
+	if len(orderID) > maxOrderIDLength || hasControlCharacter(orderID) {
+		http.Error(w, "invalid orderId", http.StatusBadRequest)
+		return
+	}
+	state := r.FormValue("state")
+	if hasControlCharacter(state) {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	description := r.FormValue("description")
+	if len(description) > maxDescriptionLength {
+		http.Error(w, "invalid description", http.StatusBadRequest)
+		return
+	}
+	var metadata map[string]interface{}
+	if s := r.FormValue("metadata"); s != "" {
+		if len(s) > maxMetadataSize || json.Unmarshal([]byte(s), &metadata) != nil {
+			http.Error(w, "invalid metadata", http.StatusBadRequest)
+			return
+		}
+	}
+	splitRule := r.FormValue("split")
+	split, err := splitShares(splitRule)
+	if err != nil {
+		http.Error(w, "invalid split", http.StatusBadRequest)
+		return
+	}
+	if split != nil && splitRule == "" {
+		splitRule = config.DefaultSplitRule
+	}
+	var idempotencyKey *store.IdempotencyKey
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "invalid "+idempotencyKeyHeader, http.StatusBadRequest)
+			return
+		}
+		// Serialize concurrent requests with the same key.
+		lockKey := idempotencyKeyHeader + ":" + key
+		locks.Lock(lockKey)
+		defer locks.Unlock(lockKey)
+		idempotencyKey, err = LoadIdempotencyKey(key)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		requestHash := paymentRequestHash(r)
+		if idempotencyKey != nil {
+			if idempotencyKey.RequestHash != requestHash {
+				http.Error(w, idempotencyKeyHeader+" is used with a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			handleIdempotentPay(w, idempotencyKey)
+			return
+		}
+		idempotencyKey = &store.IdempotencyKey{
+			Key:         key,
+			RequestHash: requestHash,
+			CreatedAt:   time.Now().UTC(),
+		}
+	}
 	const nanoCurrency = "XNO"
 	currency := r.FormValue("currency")
 	if currency != "" && currency != nanoCurrency {
@@ -105,10 +204,26 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 		Amount:           units.NanoToRaw(amount),
 		AmountInCurrency: amountInCurrency,
 		Currency:         currency,
-		State:            r.FormValue("state"),
+		State:            state,
+		OrderID:          orderID,
+		Description:      description,
+		Metadata:         metadata,
+		AllowedDuration:  allowedDuration,
+		SplitRule:        splitRule,
+		Split:            split,
+		Status:           StatusPending,
 		CreatedAt:        time.Now().UTC(),
 	}
-	err = payment.SaveNew()
+	if idempotencyKey != nil {
+		err = payment.SaveNewWithIdempotencyKey(idempotencyKey)
+	} else {
+		err = payment.SaveNew()
+	}
+	if err == store.ErrKeyExists {
+		// Same key is used on another instance at the same time.
+		handleIdempotentPayConflict(w, idempotencyKey)
+		return
+	}
 	if err != nil {
 		log.Error(err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -135,6 +250,57 @@ func handlePay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleIdempotentPayConflict writes the response for the payment that is created with the same idempotency key
+// after the key is checked by this request.
+func handleIdempotentPayConflict(w http.ResponseWriter, k *store.IdempotencyKey) {
+	saved, err := LoadIdempotencyKey(k.Key)
+	if err != nil || saved == nil {
+		log.Errorln("cannot load idempotency key:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if saved.RequestHash != k.RequestHash {
+		http.Error(w, idempotencyKeyHeader+" is used with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	handleIdempotentPay(w, saved)
+}
+
+// handleIdempotentPay writes the response for the payment that is created before with the same idempotency key.
+// hasControlCharacter returns true if s contains a control character.
+// Order IDs and states are used in index keys separated with a NUL byte, so control characters are not allowed in them.
+func hasControlCharacter(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) != -1
+}
+
+func handleIdempotentPay(w http.ResponseWriter, k *store.IdempotencyKey) {
+	payment, err := LoadPayment(k.Account)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	token, err := NewToken(payment.Index)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	response := NewResponse(payment, token)
+	b, err := json.Marshal(&response)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf("returning existing payment for idempotency key: %s", k.Key)
+	w.Header().Set("Idempotent-Replayed", "true")
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
 func handleVerify(w http.ResponseWriter, r *http.Request) {
 	token := r.FormValue("token")
 	if token == "" {
@@ -175,6 +341,55 @@ func handleVerify(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return
+	}
+	claims, err := ParseToken(token)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return
+	}
+	key, err := node.DeterministicKey(config.Seed, claims.Index)
+	if err != nil {
+		http.Error(w, "invalid token", http.StatusBadRequest)
+		return
+	}
+	payment, err := CancelPayment(key.Account)
+	if err == errPaymentNotFound {
+		log.Debugln("token not found:", token)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if err == errPaymentNotCancellable || err == store.ErrConflict {
+		// Payment may be updated by the leader instance at the same time.
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	response := NewResponse(payment, token)
+	b, err := json.Marshal(&response)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		log.Debug(err)
+	}
+}
+
 func handleWebsocket(conn *websocket.Conn) {
 	r := conn.Request()
 	token := r.FormValue("token")
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasControlCharacter(t *testing.T) {
+	cases := map[string]bool{
+		"":            false,
+		"order-1":     false,
+		"sipariş 1":   false,
+		"a\x00b":      true,
+		"a\nb":        true,
+		"\x7f":        true,
+		"tab\tinside": true,
+		"emoji 🙂 ok":  false,
+	}
+	for s, expected := range cases {
+		assert.Equal(t, expected, hasControlCharacter(s), "%q", s)
+	}
+}
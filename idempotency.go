@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Idempotency-Key header maps a key sent by the client to the payment created with it.
+// Retried requests with the same key return the original payment instead of creating a new one.
+// Keys are saved in the payment store in the same transaction as the payment.
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
+// Bucket in the local database that idempotency keys were kept in before they are saved in the payment store.
+// Bolt store uses the same bucket so it is only moved with other backends.
+const localIdempotencyKeysBucket = "idempotencyKeys"
+
+// idempotencyKeyExpired returns true if the key can be used for a new payment.
+func idempotencyKeyExpired(k *store.IdempotencyKey) bool {
+	return time.Since(k.CreatedAt) > config.IdempotencyKeyTTL
+}
+
+// LoadIdempotencyKey returns the saved key. Returns nil if the key is not found or expired.
+// Expired keys are deleted so that the key can be used for a new payment.
+func LoadIdempotencyKey(key string) (*store.IdempotencyKey, error) {
+	k, err := paymentStore.GetIdempotencyKey(key)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if idempotencyKeyExpired(k) {
+		return nil, deleteExpiredIdempotencyKeys()
+	}
+	return k, nil
+}
+
+// moveLocalIdempotencyKeys moves the keys that are saved in the local database by older versions to the payment store.
+func moveLocalIdempotencyKeys() error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(localIdempotencyKeysBucket))
+		if b == nil {
+			return nil
+		}
+		count := 0
+		err := b.ForEach(func(k, v []byte) error {
+			key := &store.IdempotencyKey{Key: string(k)}
+			if err := json.Unmarshal(v, key); err != nil || idempotencyKeyExpired(key) {
+				return nil
+			}
+			count++
+			return paymentStore.PutIdempotencyKey(key)
+		})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Noticef("moved %d idempotency keys to the payment store", count)
+		}
+		return tx.DeleteBucket([]byte(localIdempotencyKeysBucket))
+	})
+}
+
+// paymentRequestHash returns a hash of the parameters of a payment request.
+func paymentRequestHash(r *http.Request) string {
+	h := sha256.New()
+	for _, name := range []string{"amount", "currency", "state", "duration", "orderId", "description", "metadata"} {
+		h.Write([]byte(r.FormValue(name))) // nolint:errcheck
+		h.Write([]byte{0})                 // nolint:errcheck
+	}
+	// Added separately so that hashes of the requests without a split rule do not change.
+	if split := r.FormValue("split"); split != "" {
+		h.Write([]byte(split)) // nolint:errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// runIdempotencyKeyCleaner periodically deletes expired keys from database.
+func runIdempotencyKeyCleaner() {
+	defer workersWG.Done()
+	for {
+		err := deleteExpiredIdempotencyKeys()
+		if err != nil {
+			log.Errorln("cannot delete expired idempotency keys:", err)
+		}
+		select {
+		case <-time.After(time.Hour):
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+func deleteExpiredIdempotencyKeys() error {
+	return paymentStore.DeleteIdempotencyKeys(time.Now().Add(-config.IdempotencyKeyTTL))
+}
@@ -0,0 +1,27 @@
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Exponential returns the duration to wait before the next attempt.
+// Duration starts from minWait and doubles after every attempt until it reaches maxWait.
+// Half of the duration is randomized to prevent retries from being synchronized.
+func Exponential(attempt int, minWait, maxWait time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := minWait
+	for i := 1; i < attempt && d < maxWait; i++ {
+		d *= 2
+	}
+	if d > maxWait || d <= 0 {
+		d = maxWait
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half))) // nolint:gosec
+}
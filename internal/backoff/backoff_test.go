@@ -0,0 +1,30 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponential(t *testing.T) {
+	const minWait, maxWait = time.Second, time.Minute
+	cases := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{7, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tc := range cases {
+		for i := 0; i < 100; i++ {
+			d := Exponential(tc.attempt, minWait, maxWait)
+			assert.GreaterOrEqual(t, int64(d), int64(tc.base/2))
+			assert.Less(t, int64(d), int64(tc.base))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package nano
 
 import (
+	"context"
 	"errors"
 
 	"github.com/shopspring/decimal"
@@ -19,11 +20,16 @@ type AccountInfo struct {
 var ErrAccountNotFound = errors.New("account not found")
 
 func (n *Node) AccountInfo(account string) (*AccountInfo, error) {
+	return n.AccountInfoContext(context.Background(), account)
+}
+
+// AccountInfoContext is like AccountInfo but the request is cancelled when ctx is done.
+func (n *Node) AccountInfoContext(ctx context.Context, account string) (*AccountInfo, error) {
 	args := map[string]interface{}{
 		"account": account,
 	}
 	var response AccountInfo
-	err := n.call("account_info", args, &response)
+	err := n.call(ctx, "account_info", args, &response)
 	if err2, ok := err.(*NodeError); ok && err2.Error() == "Account not found" {
 		return nil, ErrAccountNotFound
 	}
@@ -2,6 +2,7 @@ package nano
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -20,6 +21,11 @@ type PendingBlock struct {
 }
 
 func (n *Node) Pending(account string, count int, threshold decimal.Decimal) (map[string]PendingBlock, error) {
+	return n.PendingContext(context.Background(), account, count, threshold)
+}
+
+// PendingContext is like Pending but the request is cancelled when ctx is done.
+func (n *Node) PendingContext(ctx context.Context, account string, count int, threshold decimal.Decimal) (map[string]PendingBlock, error) {
 	args := map[string]interface{}{
 		"account":   account,
 		"count":     count,
@@ -29,7 +35,7 @@ func (n *Node) Pending(account string, count int, threshold decimal.Decimal) (ma
 	var nodeResponse struct {
 		Blocks *json.RawMessage `json:"blocks"`
 	}
-	err := n.call("pending", args, &nodeResponse)
+	err := n.call(ctx, "pending", args, &nodeResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -44,9 +50,11 @@ func (n *Node) Pending(account string, count int, threshold decimal.Decimal) (ma
 	return ret, err
 }
 
-func (n *Node) BlockCreate(previous, account, representative string, balance decimal.Decimal, link, key, work string) (string, error) { // nolint:interfacer
-	block, err := blockCreate(previous, account, representative, balance.String(), link, key, work)
-	return block.Block.String(), err
+// BlockCreate creates and signs a state block. Returns the block and its hash.
+// The block is not published, so the hash can be recorded before calling Process.
+func (n *Node) BlockCreate(previous, account, representative string, balance decimal.Decimal, link, key, work string) (block, hash string, err error) { // nolint:interfacer
+	created, err := blockCreate(previous, account, representative, balance.String(), link, key, work)
+	return created.Block.String(), created.Hash, err
 }
 
 type createdBlock struct {
@@ -209,15 +217,40 @@ func accountToPublicKey(address string) (public []byte, err error) {
 }
 
 func (n *Node) Process(block string) (string, error) {
+	return n.ProcessContext(context.Background(), block)
+}
+
+// ProcessContext is like Process but the request is cancelled when ctx is done.
+// Note that the block may still be published if the request is cancelled after it is sent.
+func (n *Node) ProcessContext(ctx context.Context, block string) (string, error) {
 	args := map[string]interface{}{
 		"block": block,
 	}
 	var response struct {
 		Hash string `json:"hash"`
 	}
-	err := n.call("process", args, &response)
+	err := n.call(ctx, "process", args, &response)
 	if err != nil {
 		return "", err
 	}
 	return response.Hash, nil
 }
+
+// BlockExists returns whether the block with hash is in the ledger of the node.
+// It is used to find out if a block is published after a failed Process call.
+func (n *Node) BlockExists(ctx context.Context, hash string) (bool, error) {
+	args := map[string]interface{}{
+		"hash": hash,
+	}
+	var response struct {
+		BlockAccount string `json:"block_account"`
+	}
+	err := n.call(ctx, "block_info", args, &response)
+	if err2, ok := err.(*NodeError); ok && err2.Error() == "Block not found" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
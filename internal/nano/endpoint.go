@@ -0,0 +1,116 @@
+package nano
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// Endpoint is an RPC endpoint of a node.
+type Endpoint struct {
+	URL string
+	// Authorization HTTP header value for requests.
+	AuthorizationHeader string
+	// api-key header value for nano.nownodes.io service.
+	APIKeyHeader string
+	// Rate limit for this endpoint. Default rate limit of the Node is used if zero.
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// CircuitBreaker contains the parameters for skipping failing endpoints.
+type CircuitBreaker struct {
+	// Endpoint is skipped after this many consecutive failures. Zero means endpoints are never skipped.
+	MaxFailures int
+	// Skipped endpoint is tried again after this duration.
+	OpenDuration time.Duration
+}
+
+// EndpointStatus is the health of an endpoint.
+type EndpointStatus struct {
+	URL string `json:"url"`
+	// False while the endpoint is skipped because of consecutive failures.
+	Available bool `json:"available"`
+	// Number of failures since the last successful request.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// Endpoint is skipped until this time.
+	OpenUntil *time.Time `json:"openUntil"`
+	// Set if the endpoint reported that its rate limit is exhausted until this time.
+	RateLimitedUntil *time.Time `json:"rateLimitedUntil"`
+	// Total number of requests and failures.
+	Requests uint64 `json:"requests"`
+	Failures uint64 `json:"failures"`
+	// Set after every successful request.
+	LastSuccessAt *time.Time `json:"lastSuccessAt"`
+	// Set after every failed request.
+	LastFailureAt *time.Time `json:"lastFailureAt"`
+	// Error message of the last failed request.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// endpoint keeps the health of an Endpoint.
+// A request is considered failed if the endpoint cannot be reached or returns an invalid response.
+// Errors returned by the node in a valid response do not affect the health.
+type endpoint struct {
+	Endpoint
+	limiter *limiter
+	m       sync.Mutex
+	status  EndpointStatus
+}
+
+func newEndpoint(e Endpoint, limit RateLimit) *endpoint {
+	if e.RequestsPerSecond > 0 {
+		limit = RateLimit{RequestsPerSecond: e.RequestsPerSecond, Burst: e.Burst}
+	}
+	return &endpoint{Endpoint: e, limiter: newLimiter(limit), status: EndpointStatus{URL: e.URL}}
+}
+
+// available returns false if the circuit is open.
+func (e *endpoint) available(now time.Time) bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.status.OpenUntil == nil || !now.Before(*e.status.OpenUntil)
+}
+
+func (e *endpoint) success() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.status.OpenUntil != nil {
+		log.Noticeln("node endpoint is available again:", e.URL)
+	}
+	now := time.Now().UTC()
+	e.status.Requests++
+	e.status.ConsecutiveFailures = 0
+	e.status.OpenUntil = nil
+	e.status.LastSuccessAt = &now
+}
+
+// failure records the error and opens the circuit if the endpoint fails too many times in a row.
+// After the circuit is open for a while, the next request is allowed as a trial and a single failure opens it again.
+func (e *endpoint) failure(err error, breaker CircuitBreaker) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	now := time.Now().UTC()
+	e.status.Requests++
+	e.status.Failures++
+	e.status.ConsecutiveFailures++
+	e.status.LastFailureAt = &now
+	e.status.LastError = err.Error()
+	if breaker.MaxFailures > 0 && e.status.ConsecutiveFailures >= breaker.MaxFailures {
+		openUntil := now.Add(breaker.OpenDuration)
+		e.status.OpenUntil = &openUntil
+		log.Warningf("node endpoint %s is skipped for %s after %d consecutive failures: %s", e.URL, breaker.OpenDuration, e.status.ConsecutiveFailures, err)
+	}
+}
+
+func (e *endpoint) getStatus(now time.Time) EndpointStatus {
+	e.m.Lock()
+	defer e.m.Unlock()
+	s := e.status
+	s.Available = s.OpenUntil == nil || !now.Before(*s.OpenUntil)
+	if blockedUntil, ok := e.limiter.blockedTime(now); ok {
+		s.RateLimitedUntil = &blockedUntil
+	}
+	return s
+}
@@ -1,7 +1,10 @@
 package nano
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 )
 
 type NodeError struct {
@@ -20,3 +23,30 @@ type HTTPError struct {
 func (e *HTTPError) Error() string {
 	return fmt.Sprintf("HTTPError(status=%d, body=%q)", e.StatusCode, e.Body)
 }
+
+// TimeoutError is returned when a node request is not completed before its deadline.
+type TimeoutError struct {
+	Action string
+	Err    error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("node request %s timed out: %s", e.Action, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// timeoutError wraps err in a TimeoutError if it is caused by a deadline. Other errors are returned as is.
+func timeoutError(action string, err error) error {
+	var netErr net.Error
+	if errors.Is(err, ErrRateLimitTimeout) || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &TimeoutError{Action: action, Err: err}
+	}
+	return err
+}
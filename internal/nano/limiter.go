@@ -0,0 +1,151 @@
+package nano
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/log"
+)
+
+// ErrRateLimitTimeout is returned when a request cannot be sent before its deadline because of the rate limit.
+var ErrRateLimitTimeout = errors.New("timeout waiting for node rate limit")
+
+// Values of x-ratelimit-reset header greater than this are Unix timestamps. Smaller values are seconds from now.
+const rateLimitResetTimestampMin = 1000000000
+
+// RateLimit is the rate of requests allowed to an endpoint.
+type RateLimit struct {
+	// Requests per second on average. Zero means unlimited.
+	RequestsPerSecond float64
+	// Max number of requests that can be sent at once after the endpoint is idle for a while.
+	Burst int
+}
+
+// limiter is a token bucket that refills at a constant rate up to the burst size. Each request takes a token.
+// When a response reports that no requests remain in the current window, requests wait until the window is reset.
+type limiter struct {
+	m     sync.Mutex
+	rate  float64
+	burst float64
+	// Tokens can be negative when callers are waiting for tokens that are already reserved.
+	tokens float64
+	last   time.Time
+	// No requests are allowed before this time.
+	blockedUntil time.Time
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: limit.RequestsPerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller must wait before sending the request.
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+	var wait time.Duration
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		l.tokens--
+		if l.tokens < 0 {
+			wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+	}
+	if blocked := l.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+	return wait
+}
+
+// cancel returns the token taken by reserve.
+func (l *limiter) cancel() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.rate > 0 {
+		l.tokens++
+	}
+}
+
+// blocked returns true if the endpoint reported that no requests remain until a later time.
+func (l *limiter) blocked(now time.Time) bool {
+	_, ok := l.blockedTime(now)
+	return ok
+}
+
+// blockedTime returns the time until requests are blocked.
+func (l *limiter) blockedTime(now time.Time) (time.Time, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.blockedUntil, now.Before(l.blockedUntil)
+}
+
+// wait blocks until the request can be sent.
+// Returns ErrRateLimitTimeout without waiting if the request cannot be sent before the deadline of ctx.
+// If ctx is cancelled while waiting, the error of ctx is returned.
+func (l *limiter) wait(ctx context.Context) error {
+	d := l.reserve(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		l.cancel()
+		return ErrRateLimitTimeout
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrRateLimitTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// update adapts the limiter to x-ratelimit-remaining and x-ratelimit-reset headers of a response.
+func (l *limiter) update(header http.Header, now time.Time) {
+	remaining, err := strconv.Atoi(header.Get("x-ratelimit-remaining"))
+	if err != nil {
+		return
+	}
+	reset := parseRateLimitReset(header.Get("x-ratelimit-reset"), now)
+	l.m.Lock()
+	defer l.m.Unlock()
+	if remaining <= 0 && reset.After(now) {
+		if !now.Before(l.blockedUntil) {
+			log.Warningf("node rate limit is exhausted, waiting until %s", reset.Format(time.RFC3339))
+		}
+		l.blockedUntil = reset
+		return
+	}
+	if l.rate > 0 && float64(remaining) < l.tokens {
+		l.tokens = float64(remaining)
+	}
+}
+
+// parseRateLimitReset parses the value of x-ratelimit-reset header which is either seconds from now or a Unix timestamp.
+// Returns zero time if the value is not valid.
+func parseRateLimitReset(value string, now time.Time) time.Time {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}
+	}
+	if seconds > rateLimitResetTimestampMin {
+		return time.Unix(0, int64(seconds*float64(time.Second)))
+	}
+	return now.Add(time.Duration(seconds * float64(time.Second)))
+}
@@ -0,0 +1,62 @@
+package nano
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	l := newLimiter(RateLimit{RequestsPerSecond: 10, Burst: 2})
+	now := l.last
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	assert.Equal(t, 100*time.Millisecond, l.reserve(now))
+	assert.Equal(t, 200*time.Millisecond, l.reserve(now))
+	// Tokens are refilled over time.
+	assert.Equal(t, 100*time.Millisecond, l.reserve(now.Add(200*time.Millisecond)))
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(RateLimit{})
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, l.wait(context.Background()))
+	}
+}
+
+func TestLimiterWaitTimeout(t *testing.T) {
+	l := newLimiter(RateLimit{RequestsPerSecond: 1, Burst: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, l.wait(ctx))
+	start := time.Now()
+	assert.Equal(t, ErrRateLimitTimeout, l.wait(ctx))
+	// Caller does not wait if the deadline is too soon.
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	// Token of the failed call is returned.
+	assert.InDelta(t, 0, l.tokens, 0.1)
+}
+
+func TestLimiterUpdate(t *testing.T) {
+	l := newLimiter(RateLimit{RequestsPerSecond: 10, Burst: 10})
+	now := l.last
+
+	l.update(http.Header{"X-Ratelimit-Remaining": {"3"}}, now)
+	assert.Equal(t, float64(3), l.tokens)
+
+	l.update(http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"30"}}, now)
+	assert.True(t, l.blocked(now))
+	assert.False(t, l.blocked(now.Add(30*time.Second)))
+	assert.Equal(t, 30*time.Second, l.reserve(now))
+}
+
+func TestParseRateLimitReset(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	assert.Equal(t, now.Add(10*time.Second), parseRateLimitReset("10", now))
+	assert.Equal(t, time.Unix(1600000060, 0), parseRateLimitReset("1600000060", now))
+	assert.True(t, parseRateLimitReset("", now).IsZero())
+	assert.True(t, parseRateLimitReset("-1", now).IsZero())
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"time"
 
@@ -12,108 +14,136 @@ import (
 )
 
 type Node struct {
-	url      string
-	client   http.Client
-	sleep    time.Duration
-	auth     string
-	apiKey   string
-	requestC chan *nodeRequest
-	closeC   chan struct{}
+	endpoints []*endpoint
+	breaker   CircuitBreaker
+	client    http.Client
 }
 
-func New(nodeURL string, timeout, sleep time.Duration, authorization, apiKey string) *Node {
+// New returns a Node that sends requests to the first available endpoint.
+// If a request fails, it is tried on the next endpoint. Endpoints that fail repeatedly are skipped as configured in breaker.
+// Requests to each endpoint are limited by limit unless the endpoint has its own rate limit.
+func New(endpoints []Endpoint, timeout time.Duration, limit RateLimit, breaker CircuitBreaker) *Node {
 	n := &Node{
-		url: nodeURL,
+		endpoints: make([]*endpoint, 0, len(endpoints)),
+		breaker:   breaker,
 		client: http.Client{
 			Timeout: timeout,
 		},
-		sleep:    sleep,
-		auth:     authorization,
-		apiKey:   apiKey,
-		requestC: make(chan *nodeRequest),
-		closeC:   make(chan struct{}),
 	}
-	go n.caller()
+	for _, e := range endpoints {
+		n.endpoints = append(n.endpoints, newEndpoint(e, limit))
+	}
 	return n
 }
 
-func (n *Node) Close() {
-	close(n.closeC)
+// call sends the request to the node. The request is cancelled when ctx is done.
+// Requests wait for the rate limit for at most the node timeout. Each request to an endpoint also times out with the node timeout.
+// Errors caused by deadlines are returned as *TimeoutError.
+// Failed process requests are tried on the next endpoint only if they have not reached the node.
+func (n *Node) call(ctx context.Context, action string, args map[string]interface{}, response interface{}) error {
+	if args == nil {
+		args = make(map[string]interface{})
+	}
+	args["action"] = action
+	log.Debugf("node request: %#v", args)
+	data, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	waitCtx := ctx
+	if n.client.Timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, n.client.Timeout)
+		defer cancel()
+	}
+	var lastErr error
+	for _, e := range n.availableEndpoints() {
+		err = e.limiter.wait(waitCtx)
+		if err != nil {
+			return timeoutError(action, err)
+		}
+		err = n.request(ctx, e, data, response)
+		if err == nil {
+			e.success()
+			return nil
+		}
+		if _, ok := err.(*NodeError); ok {
+			// Node is reachable and returned an error for the request. Other endpoints would return the same error.
+			e.success()
+			return err
+		}
+		if ctx.Err() != nil {
+			// Request is cancelled by the caller. It is not a failure of the endpoint.
+			return timeoutError(action, ctx.Err())
+		}
+		e.failure(err, n.breaker)
+		log.Warningf("node request to %s failed: %s", e.URL, err)
+		if action == "process" && !notDelivered(err) {
+			// Block may be published by this endpoint. Sending it to another endpoint would fail with "Old block" or "Fork".
+			// Caller must check if the block is published before trying again.
+			return timeoutError(action, err)
+		}
+		lastErr = err
+	}
+	return timeoutError(action, lastErr)
 }
 
-type nodeRequest struct {
-	action   string
-	args     map[string]interface{}
-	response interface{}
-	done     chan struct{}
-	err      error
+// notDelivered returns true if err shows that the request has not reached the node.
+// Connection errors and client errors from proxies are such errors. Timeouts and server errors may happen after the node has handled the request.
+func notDelivered(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var httpErr *HTTPError
+	return errors.As(err, &httpErr) && httpErr.StatusCode < 500
 }
 
-func (n *Node) caller() {
-	for {
-		select {
-		case req := <-n.requestC:
-			req.err = n.callNow(req.action, req.args, req.response)
-			close(req.done)
-		case <-n.closeC:
-			return
-		}
-		select {
-		case <-time.After(n.sleep):
-		case <-n.closeC:
-			return
+// availableEndpoints returns the endpoints to try in order.
+// Endpoints are skipped if they fail repeatedly or report that their rate limit is exhausted.
+// If all of the endpoints are skipped, all of them are returned so that requests are not failed without trying.
+func (n *Node) availableEndpoints() []*endpoint {
+	now := time.Now()
+	ret := make([]*endpoint, 0, len(n.endpoints))
+	for _, e := range n.endpoints {
+		if e.available(now) && !e.limiter.blocked(now) {
+			ret = append(ret, e)
 		}
 	}
+	if len(ret) == 0 {
+		return n.endpoints
+	}
+	return ret
 }
 
-func (n *Node) call(action string, args map[string]interface{}, response interface{}) error {
-	if n.sleep == 0 {
-		return n.callNow(action, args, response)
-	}
-	req := &nodeRequest{action, args, response, make(chan struct{}), nil}
-	select {
-	case n.requestC <- req:
-		<-req.done
-		return req.err
-	case <-time.After(n.client.Timeout):
-		return context.Canceled
+// Status returns the health of the endpoints in order.
+func (n *Node) Status() []EndpointStatus {
+	now := time.Now()
+	ret := make([]EndpointStatus, 0, len(n.endpoints))
+	for _, e := range n.endpoints {
+		ret = append(ret, e.getStatus(now))
 	}
+	return ret
 }
 
-func (n *Node) callNow(action string, args map[string]interface{}, response interface{}) error {
-	if args == nil {
-		args = make(map[string]interface{})
-	}
-	args["action"] = action
-	log.Debugf("node request: %#v", args)
-	data, err := json.Marshal(args)
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(data)) // nolint:noctx // client timeout set
+func (n *Node) request(ctx context.Context, e *endpoint, data []byte, response interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	if n.auth != "" {
-		req.Header.Set("authorization", n.auth)
+	if e.AuthorizationHeader != "" {
+		req.Header.Set("authorization", e.AuthorizationHeader)
 	}
-	if n.apiKey != "" {
-		req.Header.Set("api-key", n.apiKey)
+	if e.APIKeyHeader != "" {
+		req.Header.Set("api-key", e.APIKeyHeader)
 	}
 	resp, err := n.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	rateLimitRemaining := resp.Header.Get("x-ratelimit-remaining")
-	if rateLimitRemaining != "" {
-		log.Debugln("Node rate limit remaining:", rateLimitRemaining)
-	}
-	rateLimitReset := resp.Header.Get("x-ratelimit-reset")
-	if rateLimitReset != "" {
-		log.Debugln("Node rate limit reset:", rateLimitReset)
-	}
+	e.limiter.update(resp.Header, time.Now())
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return err
@@ -124,6 +154,7 @@ func (n *Node) callNow(action string, args map[string]interface{}, response inte
 	if err == nil && errorResponse.Message != nil {
 		return &errorResponse
 	}
+	// Other statuses without a node error are returned from proxies and they are tried on the next endpoint.
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return &HTTPError{
 			StatusCode: resp.StatusCode,
@@ -0,0 +1,219 @@
+package nano
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeFailover(t *testing.T) {
+	var downRequests, upRequests int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downRequests, 1)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upRequests, 1)
+		assert.Equal(t, "secret", r.Header.Get("api-key"))
+		_, _ = w.Write([]byte(`{"frontier": "F", "balance": "1"}`))
+	}))
+	defer up.Close()
+
+	n := New([]Endpoint{{URL: down.URL}, {URL: up.URL, APIKeyHeader: "secret"}}, time.Second, RateLimit{}, CircuitBreaker{MaxFailures: 2, OpenDuration: time.Hour})
+	for i := 0; i < 3; i++ {
+		info, err := n.AccountInfo("nano_test")
+		assert.NoError(t, err)
+		assert.Equal(t, "F", info.Frontier)
+	}
+	// First endpoint is skipped after 2 failures.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&downRequests))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&upRequests))
+
+	status := n.Status()
+	assert.Len(t, status, 2)
+	assert.False(t, status[0].Available)
+	assert.Equal(t, 2, status[0].ConsecutiveFailures)
+	assert.NotNil(t, status[0].OpenUntil)
+	assert.Contains(t, status[0].LastError, "status=502")
+	assert.True(t, status[1].Available)
+	assert.Equal(t, uint64(3), status[1].Requests)
+	assert.Equal(t, uint64(0), status[1].Failures)
+}
+
+func TestNodeErrorDoesNotFailover(t *testing.T) {
+	var secondRequests int32
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"error": "Account not found"}`))
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondRequests, 1)
+	}))
+	defer second.Close()
+
+	n := New([]Endpoint{{URL: first.URL}, {URL: second.URL}}, time.Second, RateLimit{}, CircuitBreaker{MaxFailures: 1, OpenDuration: time.Hour})
+	_, err := n.AccountInfo("nano_test")
+	assert.Equal(t, ErrAccountNotFound, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&secondRequests))
+	assert.True(t, n.Status()[0].Available)
+}
+
+func TestNodeErrorWithHTTPStatus(t *testing.T) {
+	var secondRequests int32
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error": "Account not found"}`))
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondRequests, 1)
+	}))
+	defer second.Close()
+
+	n := New([]Endpoint{{URL: first.URL}, {URL: second.URL}}, time.Second, RateLimit{}, CircuitBreaker{MaxFailures: 1, OpenDuration: time.Hour})
+	_, err := n.AccountInfo("nano_test")
+	assert.Equal(t, ErrAccountNotFound, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&secondRequests))
+}
+
+func TestProcessFailover(t *testing.T) {
+	var secondRequests int32
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondRequests, 1)
+		_, _ = w.Write([]byte(`{"hash": "H"}`))
+	}))
+	defer second.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	// Requests that have not reached the node are tried on the next endpoint.
+	for _, url := range []string{closed.URL, limited.URL} {
+		n := New([]Endpoint{{URL: url}, {URL: second.URL}}, time.Second, RateLimit{}, CircuitBreaker{})
+		hash, err := n.Process("{}")
+		assert.NoError(t, err)
+		assert.Equal(t, "H", hash)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondRequests))
+
+	// Block may be published if the request has reached the node.
+	n := New([]Endpoint{{URL: down.URL}, {URL: second.URL}}, time.Second, RateLimit{}, CircuitBreaker{})
+	_, err := n.Process("{}")
+	assert.IsType(t, &HTTPError{}, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondRequests))
+
+	// Other requests are tried on the next endpoint.
+	_, err = n.AccountInfo("nano_test")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&secondRequests))
+}
+
+func TestNodeAllEndpointsSkipped(t *testing.T) {
+	var requests int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	n := New([]Endpoint{{URL: down.URL}}, time.Second, RateLimit{}, CircuitBreaker{MaxFailures: 1, OpenDuration: time.Hour})
+	for i := 0; i < 2; i++ {
+		_, err := n.AccountInfo("nano_test")
+		assert.IsType(t, &HTTPError{}, err)
+	}
+	// Requests are still sent when there is no other endpoint to try.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestNodeCancel(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	n := New([]Endpoint{{URL: slow.URL}}, time.Minute, RateLimit{}, CircuitBreaker{MaxFailures: 1, OpenDuration: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := n.AccountInfoContext(ctx, "nano_test")
+	assert.Equal(t, context.Canceled, err)
+	// Cancelled requests are not counted as failures.
+	assert.True(t, n.Status()[0].Available)
+}
+
+func TestNodeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	n := New([]Endpoint{{URL: slow.URL}}, 50*time.Millisecond, RateLimit{}, CircuitBreaker{})
+	_, err := n.AccountInfo("nano_test")
+	var timeoutErr *TimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, "account_info", timeoutErr.Action)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n = New([]Endpoint{{URL: slow.URL}}, time.Minute, RateLimit{}, CircuitBreaker{})
+	_, err = n.PendingContext(ctx, "nano_test", 1, decimal.Zero)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, errors.As(err, &timeoutErr))
+}
+
+func TestNodeRateLimitTimeout(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"hash": "H"}`))
+	}))
+	defer up.Close()
+
+	n := New([]Endpoint{{URL: up.URL}}, 100*time.Millisecond, RateLimit{RequestsPerSecond: 1, Burst: 1}, CircuitBreaker{})
+	hash, err := n.Process("{}")
+	assert.NoError(t, err)
+	assert.Equal(t, "H", hash)
+	// Next request would wait longer than the node timeout.
+	_, err = n.Process("{}")
+	assert.True(t, errors.Is(err, ErrRateLimitTimeout))
+	assert.IsType(t, &TimeoutError{}, err)
+}
+
+func TestBlockExists(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		assert.Equal(t, "block_info", req["action"])
+		if req["hash"] == "A" {
+			_, _ = w.Write([]byte(`{"block_account": "nano_test"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"error": "Block not found"}`))
+	}))
+	defer s.Close()
+
+	n := New([]Endpoint{{URL: s.URL}}, time.Second, RateLimit{}, CircuitBreaker{})
+	exists, err := n.BlockExists(context.Background(), "A")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = n.BlockExists(context.Background(), "B")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
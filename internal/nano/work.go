@@ -1,10 +1,14 @@
 package nano
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"hash"
+	"math"
 	"runtime"
+	"sync"
 
 	"github.com/cenkalti/log"
 	"golang.org/x/crypto/blake2b"
@@ -15,28 +19,56 @@ var (
 	workThresholdForRecv uint64 = 0xfffffe0000000000
 )
 
-func GenerateWork(hash string, forSend bool) (string, error) {
+// Workers check if the context is done after trying this many nonces.
+const workCancelCheckInterval = 1 << 14
+
+func workThreshold(forSend bool) uint64 {
+	if forSend {
+		return workThresholdForSend
+	}
+	return workThresholdForRecv
+}
+
+// GenerateWork finds the work for hash on the local CPU.
+// Nonce space is split into GOMAXPROCS ranges and each range is searched by a separate goroutine from a random starting point.
+// Returns the error of ctx if it is done before the work is found.
+func GenerateWork(ctx context.Context, hash string, forSend bool) (string, error) {
 	b, err := hex.DecodeString(hash)
 	if err != nil {
 		return "", err
 	}
-	const hashSize = 8
-	digest, err := blake2b.New(hashSize, nil)
+	var offset [8]byte
+	_, err = rand.Read(offset[:])
 	if err != nil {
 		return "", err
 	}
-	var workThreshold uint64
-	if forSend {
-		workThreshold = workThresholdForSend
-	} else {
-		workThreshold = workThresholdForRecv
+	start := binary.LittleEndian.Uint64(offset[:])
+	threshold := workThreshold(forSend)
+	workers := runtime.GOMAXPROCS(0)
+	rangeSize := math.MaxUint64 / uint64(workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make(chan uint64, workers)
+	var wg sync.WaitGroup
+	log.Debug("starting work")
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+			if nonce, ok := searchWork(ctx, b, nonce, threshold); ok {
+				found <- nonce
+			}
+		}(start + uint64(i)*rangeSize)
 	}
 	var nonce uint64
-	log.Debug("starting work")
-	for ; !validateWork(digest, b, nonce, workThreshold); nonce++ {
-		if nonce%1000 == 0 {
-			runtime.Gosched()
-		}
+	select {
+	case nonce = <-found:
+		cancel()
+		wg.Wait()
+	case <-ctx.Done():
+		wg.Wait()
+		return "", ctx.Err()
 	}
 	log.Debug("work finished")
 	work := make([]byte, 8)
@@ -44,6 +76,34 @@ func GenerateWork(hash string, forSend bool) (string, error) {
 	return hex.EncodeToString(work), nil
 }
 
+// searchWork tries nonces starting from nonce until one meets the threshold or ctx is done.
+func searchWork(ctx context.Context, block []byte, nonce, threshold uint64) (uint64, bool) {
+	const hashSize = 8
+	digest, err := blake2b.New(hashSize, nil)
+	if err != nil {
+		return 0, false
+	}
+	b := make([]byte, 8)
+	sum := make([]byte, 0, hashSize)
+	for {
+		for i := 0; i < workCancelCheckInterval; i++ {
+			binary.LittleEndian.PutUint64(b, nonce)
+			digest.Reset()
+			_, _ = digest.Write(b)
+			_, _ = digest.Write(block)
+			if binary.LittleEndian.Uint64(digest.Sum(sum)) >= threshold {
+				return nonce, true
+			}
+			nonce++
+		}
+		select {
+		case <-ctx.Done():
+			return 0, false
+		default:
+		}
+	}
+}
+
 func validateWork(digest hash.Hash, block []byte, work uint64, workThreshold uint64) bool {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, work)
@@ -1,18 +1,83 @@
 package nano
 
-import "testing"
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
 
-// func TestGenerateWork(t *testing.T) {
-// 	hash := "4B82B23F17BFC0C6109543962E9C4AFEC8CBBCA6579C438B23B62E6BDCE6E78B"
-// 	work, _ := GenerateWork(hash)
-// 	if work != "0000000003e8fc75" {
-// 		t.FailNow()
-// 	}
-// }
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// generateWorkSerial is the previous implementation of GenerateWork that is kept for comparing in benchmarks.
+func generateWorkSerial(hash string, forSend bool) (string, error) {
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+	const hashSize = 8
+	digest, err := blake2b.New(hashSize, nil)
+	if err != nil {
+		return "", err
+	}
+	workThreshold := workThreshold(forSend)
+	var nonce uint64
+	for ; !validateWork(digest, b, nonce, workThreshold); nonce++ {
+		if nonce%1000 == 0 {
+			runtime.Gosched()
+		}
+	}
+	work := make([]byte, 8)
+	binary.BigEndian.PutUint64(work, nonce)
+	return hex.EncodeToString(work), nil
+}
+
+func TestGenerateWork(t *testing.T) {
+	lowerWorkThresholds(t)
+	for _, forSend := range []bool{true, false} {
+		work, err := GenerateWork(context.Background(), testWorkHash, forSend)
+		assert.NoError(t, err)
+		assert.NoError(t, ValidateWork(testWorkHash, work, forSend))
+	}
+}
+
+func TestGenerateWorkCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// Threshold cannot be met so work is searched until ctx is done.
+	send := workThresholdForSend
+	workThresholdForSend = 0xffffffffffffffff
+	defer func() { workThresholdForSend = send }()
+	_, err := GenerateWork(ctx, testWorkHash, true)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// Thresholds are lowered in benchmarks so that each iteration takes milliseconds instead of minutes.
+const benchmarkWorkThreshold = 0xffffc00000000000
+
+// benchmarkWorkHash returns a different hash for each iteration so that results do not depend on a single lucky hash.
+func benchmarkWorkHash(n int) string {
+	return fmt.Sprintf("%064X", n)
+}
 
 func BenchmarkGenerateWork(b *testing.B) {
-	workThresholdForSend = 0xfff0000000000000
+	send := workThresholdForSend
+	workThresholdForSend = benchmarkWorkThreshold
+	defer func() { workThresholdForSend = send }()
+	for n := 0; n < b.N; n++ {
+		_, _ = GenerateWork(context.Background(), benchmarkWorkHash(n), true)
+	}
+}
+
+func BenchmarkGenerateWorkSerial(b *testing.B) {
+	send := workThresholdForSend
+	workThresholdForSend = benchmarkWorkThreshold
+	defer func() { workThresholdForSend = send }()
 	for n := 0; n < b.N; n++ {
-		GenerateWork("42473809202D318F7DFA794B277E78AE3824836A674B1B88BEC1BBC277A87D52", true)
+		_, _ = generateWorkSerial(benchmarkWorkHash(n), true)
 	}
 }
@@ -0,0 +1,207 @@
+package nano
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/log"
+	"golang.org/x/crypto/blake2b"
+)
+
+// ErrInvalidWork is returned when a remote provider returns work that does not meet the threshold.
+var ErrInvalidWork = errors.New("invalid work")
+
+// WorkProvider generates proof of work for blocks.
+type WorkProvider interface {
+	// GenerateWork returns the work for the block hash (or the public key for the first block of an account).
+	// Work for send blocks requires a higher threshold than receive blocks.
+	// Generation is aborted when ctx is done.
+	GenerateWork(ctx context.Context, hash string, forSend bool) (string, error)
+}
+
+// LocalWork generates work on the local CPU.
+type LocalWork struct{}
+
+var _ WorkProvider = LocalWork{}
+
+func (LocalWork) GenerateWork(ctx context.Context, hash string, forSend bool) (string, error) {
+	return GenerateWork(ctx, hash, forSend)
+}
+
+var _ WorkProvider = (*Node)(nil)
+
+// GenerateWork requests work from the node with work_generate RPC.
+// Work is validated before it is returned.
+func (n *Node) GenerateWork(ctx context.Context, hash string, forSend bool) (string, error) {
+	args := map[string]interface{}{
+		"hash":       hash,
+		"difficulty": workDifficulty(forSend),
+	}
+	var response workResponse
+	err := n.call(ctx, "work_generate", args, &response)
+	if err != nil {
+		return "", err
+	}
+	return response.Work, ValidateWork(hash, response.Work, forSend)
+}
+
+// WorkValidator checks work returned from external sources.
+type WorkValidator interface {
+	// ValidateWork returns ErrInvalidWork if the work for the block hash does not meet the threshold.
+	ValidateWork(ctx context.Context, hash, work string, forSend bool) error
+}
+
+var _ WorkValidator = (*Node)(nil)
+
+// ValidateWork checks the work with work_validate RPC of the node.
+func (n *Node) ValidateWork(ctx context.Context, hash, work string, forSend bool) error {
+	args := map[string]interface{}{
+		"hash":       hash,
+		"work":       work,
+		"difficulty": workDifficulty(forSend),
+	}
+	var response struct {
+		Valid string `json:"valid"`
+	}
+	err := n.call(ctx, "work_validate", args, &response)
+	if err != nil {
+		return err
+	}
+	if response.Valid != "1" {
+		return ErrInvalidWork
+	}
+	return nil
+}
+
+type workResponse struct {
+	Work  string `json:"work"`
+	Error string `json:"error"`
+}
+
+// WorkServers requests work from external work servers that implement work_generate RPC.
+// Servers are tried in order until one of them returns valid work.
+type WorkServers struct {
+	urls      []string
+	client    http.Client
+	validator WorkValidator
+}
+
+var _ WorkProvider = (*WorkServers)(nil)
+
+// NewWorkServers returns a WorkProvider that requests work from urls.
+// timeout is applied to each request separately.
+// Work is validated locally and then with validator if it is not nil.
+// If validator cannot be reached, locally validated work is accepted.
+func NewWorkServers(urls []string, timeout time.Duration, validator WorkValidator) *WorkServers {
+	return &WorkServers{
+		urls: urls,
+		client: http.Client{
+			Timeout: timeout,
+		},
+		validator: validator,
+	}
+}
+
+func (s *WorkServers) GenerateWork(ctx context.Context, hash string, forSend bool) (string, error) {
+	if len(s.urls) == 0 {
+		return "", errors.New("no work server")
+	}
+	var errs []string
+	for _, url := range s.urls {
+		work, err := s.generate(ctx, url, hash, forSend)
+		if err == nil {
+			return work, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		log.Warningf("cannot generate work with %s: %s", url, err)
+		errs = append(errs, url+": "+err.Error())
+	}
+	return "", fmt.Errorf("all work servers failed: %s", strings.Join(errs, ", "))
+}
+
+func (s *WorkServers) generate(ctx context.Context, url, hash string, forSend bool) (string, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"action":     "work_generate",
+		"hash":       hash,
+		"difficulty": workDifficulty(forSend),
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", &HTTPError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+	var response workResponse
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return "", err
+	}
+	if response.Error != "" {
+		return "", errors.New(response.Error)
+	}
+	err = ValidateWork(hash, response.Work, forSend)
+	if err != nil || s.validator == nil {
+		return response.Work, err
+	}
+	err = s.validator.ValidateWork(ctx, hash, response.Work, forSend)
+	if err != nil && err != ErrInvalidWork {
+		log.Warningf("cannot validate work from %s, using locally validated work: %s", url, err)
+		return response.Work, nil
+	}
+	return response.Work, err
+}
+
+// workDifficulty returns the threshold in the format of work_generate and work_validate RPCs.
+func workDifficulty(forSend bool) string {
+	return fmt.Sprintf("%016x", workThreshold(forSend))
+}
+
+// ValidateWork checks the work for the block hash the same way as work_validate RPC of the node.
+// Returns ErrInvalidWork if the work does not meet the threshold.
+func ValidateWork(hash, work string, forSend bool) error {
+	b, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	w, err := hex.DecodeString(work)
+	if err != nil || len(w) != 8 {
+		return ErrInvalidWork
+	}
+	const hashSize = 8
+	digest, err := blake2b.New(hashSize, nil)
+	if err != nil {
+		return err
+	}
+	if !validateWork(digest, b, binary.BigEndian.Uint64(w), workThreshold(forSend)) {
+		return ErrInvalidWork
+	}
+	return nil
+}
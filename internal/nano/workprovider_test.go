@@ -0,0 +1,101 @@
+package nano
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWorkHash = "42473809202D318F7DFA794B277E78AE3824836A674B1B88BEC1BBC277A87D52"
+
+// lowerWorkThresholds makes work generation fast for tests.
+func lowerWorkThresholds(t *testing.T) {
+	send, recv := workThresholdForSend, workThresholdForRecv
+	workThresholdForSend, workThresholdForRecv = 0xfff0000000000000, 0xff00000000000000
+	t.Cleanup(func() { workThresholdForSend, workThresholdForRecv = send, recv })
+}
+
+func TestValidateWork(t *testing.T) {
+	lowerWorkThresholds(t)
+	work, err := GenerateWork(context.Background(), testWorkHash, true)
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWork(testWorkHash, work, true))
+	assert.NoError(t, ValidateWork(testWorkHash, work, false))
+	assert.Equal(t, ErrInvalidWork, ValidateWork(testWorkHash, "zz", true))
+	assert.Equal(t, ErrInvalidWork, ValidateWork(testWorkHash, "00", true))
+}
+
+func TestWorkServersFailover(t *testing.T) {
+	lowerWorkThresholds(t)
+	work, err := GenerateWork(context.Background(), testWorkHash, true)
+	assert.NoError(t, err)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(workResponse{Work: "0000000000000000"})
+	}))
+	defer invalid.Close()
+	var request map[string]string
+	valid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		_ = json.NewEncoder(w).Encode(workResponse{Work: work})
+	}))
+	defer valid.Close()
+
+	s := NewWorkServers([]string{down.URL, invalid.URL, valid.URL}, time.Second, nil)
+	got, err := s.GenerateWork(context.Background(), testWorkHash, true)
+	assert.NoError(t, err)
+	assert.Equal(t, work, got)
+	assert.Equal(t, "work_generate", request["action"])
+	assert.Equal(t, "fff0000000000000", request["difficulty"])
+
+	s = NewWorkServers([]string{down.URL, invalid.URL}, time.Second, nil)
+	_, err = s.GenerateWork(context.Background(), testWorkHash, true)
+	assert.Error(t, err)
+}
+
+func TestWorkServersValidateWithNode(t *testing.T) {
+	lowerWorkThresholds(t)
+	work, err := GenerateWork(context.Background(), testWorkHash, true)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(workResponse{Work: work})
+	}))
+	defer server.Close()
+	var valid string
+	var request map[string]string
+	validator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		_, _ = w.Write([]byte(`{"valid": "` + valid + `"}`))
+	}))
+	defer validator.Close()
+
+	n := New([]Endpoint{{URL: validator.URL}}, time.Second, RateLimit{}, CircuitBreaker{})
+	s := NewWorkServers([]string{server.URL}, time.Second, n)
+	valid = "1"
+	got, err := s.GenerateWork(context.Background(), testWorkHash, true)
+	assert.NoError(t, err)
+	assert.Equal(t, work, got)
+	assert.Equal(t, "work_validate", request["action"])
+	assert.Equal(t, work, request["work"])
+	assert.Equal(t, "fff0000000000000", request["difficulty"])
+
+	valid = "0"
+	_, err = s.GenerateWork(context.Background(), testWorkHash, true)
+	assert.Error(t, err)
+
+	// Locally validated work is used if the node is not reachable.
+	validator.Close()
+	got, err = s.GenerateWork(context.Background(), testWorkHash, true)
+	assert.NoError(t, err)
+	assert.Equal(t, work, got)
+}
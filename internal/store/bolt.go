@@ -0,0 +1,656 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// BoltPaymentsBucket is the name of the bucket that payments are saved in.
+// Keys are payment accounts and values are the Data of the records.
+const BoltPaymentsBucket = "payments"
+
+// Archived payments are moved to this bucket. They are not indexed.
+const archivedPaymentsBucket = "archivedPayments"
+
+// Value saved in the archive instead of the record data if the data is not kept.
+var archivedTombstone = []byte("null")
+
+// Settlements are saved in this bucket. Keys are IDs encoded as big endian uint64.
+const settlementsBucket = "settlements"
+
+// Applied migrations are saved in this bucket.
+// Keys are versions encoded as big endian uint64 and values are migration names.
+const migrationsBucket = "migrations"
+
+// Idempotency keys are saved in this bucket in JSON format.
+const idempotencyKeysBucket = "idempotencyKeys"
+
+// Deliveries are saved in these buckets. Keys are IDs formatted as zero padded decimal numbers.
+// Sequence of deliveriesBucket is used for generating IDs.
+const (
+	deliveriesBucket     = "deliveries"
+	deadDeliveriesBucket = "deadDeliveries"
+)
+
+// Secondary indexes are kept in separate buckets.
+// Keys in index buckets are the indexed value and the payment account joined with a zero byte.
+// Values are empty.
+const (
+	orderIDIndexBucket   = "orderIDIndex"
+	stateIndexBucket     = "stateIndex"
+	createdAtIndexBucket = "createdAtIndex"
+)
+
+// Size of the time prefix in createdAt index keys.
+const indexTimeSize = 8
+
+type boltIndex struct {
+	bucket string
+	value  func(r *Record) string
+}
+
+var boltIndexes = []boltIndex{
+	{orderIDIndexBucket, func(r *Record) string { return r.OrderID }},
+	{stateIndexBucket, func(r *Record) string { return r.State }},
+	{createdAtIndexBucket, func(r *Record) string { return string(encodeIndexTime(r.CreatedAt)) }},
+}
+
+// Decoder sets the indexed fields and the version of a record from its Data.
+type Decoder func(r *Record) error
+
+// Bolt is a Store that keeps payments in a bbolt database.
+type Bolt struct {
+	db     *bbolt.DB
+	decode Decoder
+}
+
+var _ Store = (*Bolt)(nil)
+
+// NewBolt returns a Store that keeps payments in db.
+// Buckets are created if they do not exist.
+// Index buckets of existing databases are built by decoding the saved records with decode.
+// db is not closed when the store is closed.
+func NewBolt(db *bbolt.DB, decode Decoder) (*Bolt, error) {
+	s := &Bolt{db: db, decode: decode}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{BoltPaymentsBucket, archivedPaymentsBucket, settlementsBucket, migrationsBucket, idempotencyKeysBucket, deliveriesBucket, deadDeliveriesBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return s.createIndexes(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// encodeIndexTime encodes t so that index keys are sorted by time.
+func encodeIndexTime(t time.Time) []byte {
+	b := make([]byte, indexTimeSize)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func indexKey(value, account string) []byte {
+	key := make([]byte, 0, len(value)+1+len(account))
+	key = append(key, value...)
+	key = append(key, 0)
+	return append(key, account...)
+}
+
+// createIndexes creates the index buckets and indexes existing records if the buckets do not exist.
+func (s *Bolt) createIndexes(tx *bbolt.Tx) error {
+	var missing []boltIndex
+	for _, idx := range boltIndexes {
+		if tx.Bucket([]byte(idx.bucket)) != nil {
+			continue
+		}
+		_, err := tx.CreateBucket([]byte(idx.bucket))
+		if err != nil {
+			return err
+		}
+		missing = append(missing, idx)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return tx.Bucket([]byte(BoltPaymentsBucket)).ForEach(func(k, v []byte) error {
+		r := &Record{Account: string(k), Data: v}
+		if err := s.decode(r); err != nil {
+			// Records that cannot be decoded cannot be loaded either.
+			return nil
+		}
+		for _, idx := range missing {
+			if value := idx.value(r); value != "" {
+				err := tx.Bucket([]byte(idx.bucket)).Put(indexKey(value, r.Account), nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// updateIndexes updates index entries of the record. old is nil for new records.
+func updateIndexes(tx *bbolt.Tx, old, r *Record) error {
+	for _, idx := range boltIndexes {
+		b := tx.Bucket([]byte(idx.bucket))
+		value := idx.value(r)
+		if old != nil {
+			oldValue := idx.value(old)
+			if oldValue == value {
+				continue
+			}
+			if oldValue != "" {
+				err := b.Delete(indexKey(oldValue, old.Account))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if value != "" {
+			err := b.Put(indexKey(value, r.Account), nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Bolt) NextSequence() (seq uint64, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		seq, err = tx.Bucket([]byte(BoltPaymentsBucket)).NextSequence()
+		return err
+	})
+	return
+}
+
+func (s *Bolt) Get(account string) (*Record, error) {
+	var r *Record
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		r = getRecord(tx.Bucket([]byte(BoltPaymentsBucket)), account)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, ErrNotFound
+	}
+	return r, nil
+}
+
+// getRecord returns the record in bucket b or nil if it does not exist.
+// Data is copied so the record can be used after the transaction is closed.
+func getRecord(b *bbolt.Bucket, account string) *Record {
+	v := b.Get([]byte(account))
+	if v == nil {
+		return nil
+	}
+	data := make([]byte, len(v))
+	copy(data, v)
+	return &Record{Account: account, Data: data}
+}
+
+func (s *Bolt) Create(r *Record) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BoltPaymentsBucket))
+		if b.Get([]byte(r.Account)) != nil || tx.Bucket([]byte(archivedPaymentsBucket)).Get([]byte(r.Account)) != nil {
+			return ErrExists
+		}
+		if r.IdempotencyKey != nil {
+			if tx.Bucket([]byte(idempotencyKeysBucket)).Get([]byte(r.IdempotencyKey.Key)) != nil {
+				return ErrKeyExists
+			}
+			err := putIdempotencyKey(tx, r.IdempotencyKey)
+			if err != nil {
+				return err
+			}
+		}
+		err := b.Put([]byte(r.Account), r.Data)
+		if err != nil {
+			return err
+		}
+		err = updateIndexes(tx, nil, r)
+		if err != nil {
+			return err
+		}
+		return addBoltDeliveries(tx, r.Deliveries)
+	})
+}
+
+func (s *Bolt) Put(r *Record) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(BoltPaymentsBucket))
+		old := getRecord(b, r.Account)
+		if old != nil {
+			if err := s.decode(old); err != nil {
+				return err
+			}
+			if r.Version != 0 && old.Version != r.Version-1 {
+				return ErrConflict
+			}
+		} else if r.Version != 0 {
+			return ErrConflict
+		}
+		err := updateIndexes(tx, old, r)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(r.Account), r.Data)
+		if err != nil {
+			return err
+		}
+		return addBoltDeliveries(tx, r.Deliveries)
+	})
+}
+
+func (s *Bolt) Archive(account string, keepData bool) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		r, err := s.delete(tx, account)
+		if err != nil || r == nil {
+			return err
+		}
+		data := r.Data
+		if !keepData {
+			data = archivedTombstone
+		}
+		return tx.Bucket([]byte(archivedPaymentsBucket)).Put([]byte(account), data)
+	})
+}
+
+func (s *Bolt) Delete(account string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		_, err := s.delete(tx, account)
+		return err
+	})
+}
+
+// delete removes the record and its index entries. Returns the deleted record or nil if it does not exist.
+func (s *Bolt) delete(tx *bbolt.Tx, account string) (*Record, error) {
+	b := tx.Bucket([]byte(BoltPaymentsBucket))
+	r := getRecord(b, account)
+	if r == nil {
+		return nil, nil
+	}
+	if err := s.decode(r); err != nil {
+		return nil, err
+	}
+	for _, idx := range boltIndexes {
+		if value := idx.value(r); value != "" {
+			err := tx.Bucket([]byte(idx.bucket)).Delete(indexKey(value, account))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, b.Delete([]byte(account))
+}
+
+func (s *Bolt) ForEach(fn func(*Record) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(BoltPaymentsBucket)).ForEach(func(k, v []byte) error {
+			return fn(&Record{Account: string(k), Data: v})
+		})
+	})
+}
+
+func (s *Bolt) FindByOrderID(orderID string) ([]*Record, error) {
+	return s.findByIndex(orderIDIndexBucket, orderID)
+}
+
+func (s *Bolt) FindByState(state string) ([]*Record, error) {
+	return s.findByIndex(stateIndexBucket, state)
+}
+
+// findByIndex returns the records with the indexed value.
+func (s *Bolt) findByIndex(bucket, value string) ([]*Record, error) {
+	ret := make([]*Record, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		payments := tx.Bucket([]byte(BoltPaymentsBucket))
+		prefix := indexKey(value, "")
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if r := getRecord(payments, string(k[len(prefix):])); r != nil {
+				ret = append(ret, r)
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// List iterates over the createdAt index in a single read transaction.
+func (s *Bolt) List(opts ListOptions, fn func(*Record) (bool, error)) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		payments := tx.Bucket([]byte(BoltPaymentsBucket))
+		c := tx.Bucket([]byte(createdAtIndexBucket)).Cursor()
+		var from, to, after []byte
+		if !opts.CreatedFrom.IsZero() {
+			from = encodeIndexTime(opts.CreatedFrom)
+		}
+		if !opts.CreatedTo.IsZero() {
+			to = encodeIndexTime(opts.CreatedTo)
+		}
+		if opts.After != nil {
+			after = indexKey(string(encodeIndexTime(opts.After.CreatedAt)), opts.After.Account)
+		}
+		var k []byte
+		if opts.Descending {
+			switch {
+			case after != nil:
+				k = seekBefore(c, after)
+			case to != nil:
+				k = seekBefore(c, to)
+			default:
+				k, _ = c.Last()
+			}
+		} else {
+			switch {
+			case after != nil:
+				if k, _ = c.Seek(after); bytes.Equal(k, after) {
+					k, _ = c.Next()
+				}
+			case from != nil:
+				k, _ = c.Seek(from)
+			default:
+				k, _ = c.First()
+			}
+		}
+		for ; k != nil; k = nextKey(c, opts.Descending) {
+			if len(k) <= indexTimeSize {
+				continue
+			}
+			t := k[:indexTimeSize]
+			if from != nil && bytes.Compare(t, from) < 0 {
+				if opts.Descending {
+					return nil
+				}
+				continue
+			}
+			if to != nil && bytes.Compare(t, to) >= 0 {
+				if !opts.Descending {
+					return nil
+				}
+				continue
+			}
+			account := string(k[indexTimeSize+1:])
+			v := payments.Get([]byte(account))
+			if v == nil {
+				continue
+			}
+			ok, err := fn(&Record{Account: account, Data: v})
+			if err != nil || !ok {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// seekBefore moves the cursor to the last key that is smaller than key.
+func seekBefore(c *bbolt.Cursor, key []byte) []byte {
+	var k []byte
+	if k, _ = c.Seek(key); k == nil {
+		// All keys are smaller than key.
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+	return k
+}
+
+func nextKey(c *bbolt.Cursor, descending bool) []byte {
+	var k []byte
+	if descending {
+		k, _ = c.Prev()
+	} else {
+		k, _ = c.Next()
+	}
+	return k
+}
+
+func encodeUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func (s *Bolt) NextSettlementID() (id uint64, err error) {
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		id, err = tx.Bucket([]byte(settlementsBucket)).NextSequence()
+		return err
+	})
+	return
+}
+
+func (s *Bolt) GetSettlement(id uint64) (*Settlement, error) {
+	var st *Settlement
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket([]byte(settlementsBucket)).Get(encodeUint64(id))
+		if value != nil {
+			st = &Settlement{ID: id, Data: append([]byte(nil), value...)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if st == nil {
+		return nil, ErrNotFound
+	}
+	return st, nil
+}
+
+func (s *Bolt) PutSettlement(st *Settlement) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(settlementsBucket)).Put(encodeUint64(st.ID), st.Data)
+	})
+}
+
+func (s *Bolt) ListSettlements(before uint64, fn func(*Settlement) (bool, error)) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(settlementsBucket))
+		c := b.Cursor()
+		var k []byte
+		if before == 0 {
+			k, _ = c.Last()
+		} else {
+			k = seekBefore(c, encodeUint64(before))
+		}
+		for ; k != nil; k, _ = c.Prev() {
+			ok, err := fn(&Settlement{ID: binary.BigEndian.Uint64(k), Data: b.Get(k)})
+			if err != nil || !ok {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Bolt) GetIdempotencyKey(key string) (*IdempotencyKey, error) {
+	var k *IdempotencyKey
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket([]byte(idempotencyKeysBucket)).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		k = &IdempotencyKey{Key: key}
+		return json.Unmarshal(value, k)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, ErrNotFound
+	}
+	return k, nil
+}
+
+func (s *Bolt) PutIdempotencyKey(k *IdempotencyKey) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return putIdempotencyKey(tx, k)
+	})
+}
+
+func putIdempotencyKey(tx *bbolt.Tx, k *IdempotencyKey) error {
+	value, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(idempotencyKeysBucket)).Put([]byte(k.Key), value)
+}
+
+// DeleteIdempotencyKeys also deletes the keys that cannot be decoded.
+func (s *Bolt) DeleteIdempotencyKeys(createdBefore time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket([]byte(idempotencyKeysBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var key IdempotencyKey
+			err := json.Unmarshal(v, &key)
+			if err != nil || key.CreatedAt.Before(createdBefore) {
+				err = c.Delete()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Zero padded so that deliveries are iterated in the order of ID.
+func formatDeliveryKey(id uint64) []byte {
+	return []byte(fmt.Sprintf("%020d", id))
+}
+
+func deliveryBucket(tx *bbolt.Tx, dead bool) *bbolt.Bucket {
+	if dead {
+		return tx.Bucket([]byte(deadDeliveriesBucket))
+	}
+	return tx.Bucket([]byte(deliveriesBucket))
+}
+
+func addBoltDeliveries(tx *bbolt.Tx, ds []*Delivery) error {
+	for _, d := range ds {
+		// This returns an error only if the Tx is closed or not writeable.
+		id, _ := tx.Bucket([]byte(deliveriesBucket)).NextSequence()
+		err := deliveryBucket(tx, d.Dead).Put(formatDeliveryKey(id), d.Data)
+		if err != nil {
+			return err
+		}
+		d.ID = id
+	}
+	return nil
+}
+
+func (s *Bolt) AddDeliveries(ds []*Delivery) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return addBoltDeliveries(tx, ds)
+	})
+}
+
+func (s *Bolt) GetDelivery(id uint64) (*Delivery, error) {
+	var d *Delivery
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, dead := range []bool{false, true} {
+			if value := deliveryBucket(tx, dead).Get(formatDeliveryKey(id)); value != nil {
+				d = &Delivery{ID: id, Dead: dead, Data: append([]byte(nil), value...)}
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, ErrNotFound
+	}
+	return d, nil
+}
+
+func (s *Bolt) UpdateDelivery(d *Delivery) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := formatDeliveryKey(d.ID)
+		if deliveryBucket(tx, false).Get(key) == nil && deliveryBucket(tx, true).Get(key) == nil {
+			return ErrNotFound
+		}
+		err := deliveryBucket(tx, !d.Dead).Delete(key)
+		if err != nil {
+			return err
+		}
+		return deliveryBucket(tx, d.Dead).Put(key, d.Data)
+	})
+}
+
+func (s *Bolt) DeleteDelivery(id uint64) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := formatDeliveryKey(id)
+		err := deliveryBucket(tx, false).Delete(key)
+		if err != nil {
+			return err
+		}
+		return deliveryBucket(tx, true).Delete(key)
+	})
+}
+
+func (s *Bolt) ListDeliveries(dead bool, fn func(*Delivery) (bool, error)) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		c := deliveryBucket(tx, dead).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			id, err := strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				return err
+			}
+			ok, err := fn(&Delivery{ID: id, Dead: dead, Data: v})
+			if err != nil || !ok {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Bolt) Migrations() ([]int, error) {
+	var versions []int
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(migrationsBucket)).ForEach(func(k, v []byte) error {
+			versions = append(versions, int(binary.BigEndian.Uint64(k)))
+			return nil
+		})
+	})
+	return versions, err
+}
+
+func (s *Bolt) SetMigrated(version int, name string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(migrationsBucket)).Put(encodeUint64(uint64(version)), []byte(name))
+	})
+}
+
+// AcquireLease always returns true.
+// A bbolt database can only be opened by a single process so there is nothing to compete with.
+func (s *Bolt) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (s *Bolt) ReleaseLease(name, owner string) error {
+	return nil
+}
+
+// Close does nothing. Database is owned by the caller.
+func (s *Bolt) Close() error {
+	return nil
+}
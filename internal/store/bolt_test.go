@@ -0,0 +1,60 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+)
+
+func openTestBolt(t *testing.T) *bbolt.DB {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBolt(t *testing.T) {
+	s, err := NewBolt(openTestBolt(t), decodeTestRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestBoltCreateIndexes(t *testing.T) {
+	db := openTestBolt(t)
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Payments saved before indexes are introduced.
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(BoltPaymentsBucket))
+		if err != nil {
+			return err
+		}
+		for _, r := range []*Record{
+			newTestRecord("a2", "o1", "", t0.Add(time.Hour)),
+			newTestRecord("a1", "o1", "s1", t0),
+		} {
+			err = b.Put([]byte(r.Account), r.Data)
+			if err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("invalid"), []byte("{"))
+	})
+	assert.NoError(t, err)
+
+	s, err := NewBolt(db, decodeTestRecord)
+	assert.NoError(t, err)
+	found, err := s.FindByOrderID("o1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2"}, accounts(found))
+	found, err = s.FindByState("s1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a1"}, accounts(found))
+	assert.Equal(t, []string{"a1", "a2"}, list(t, s, ListOptions{}))
+}
@@ -0,0 +1,458 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	// Registers "postgres" driver.
+	_ "github.com/lib/pq"
+)
+
+// Indexed fields are kept in separate columns. Payment data is saved as JSONB so that it can be queried for reporting.
+// Delivery data is saved as BYTEA so that notification bodies are sent byte for byte as they are queued.
+// created_at is saved as nanoseconds since Unix epoch to keep the precision of Go time values.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS payments (
+	account    TEXT COLLATE "C" PRIMARY KEY,
+	order_id   TEXT NOT NULL DEFAULT '',
+	state      TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL,
+	data       JSONB NOT NULL
+);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS payments_order_id_idx ON payments (order_id) WHERE order_id <> '';
+CREATE INDEX IF NOT EXISTS payments_state_idx ON payments (state) WHERE state <> '';
+CREATE INDEX IF NOT EXISTS payments_created_at_idx ON payments (created_at, account);
+CREATE SEQUENCE IF NOT EXISTS payments_index_seq;
+CREATE TABLE IF NOT EXISTS archived_payments (LIKE payments INCLUDING ALL);
+CREATE TABLE IF NOT EXISTS settlements (
+	id   BIGINT PRIMARY KEY,
+	data JSONB NOT NULL
+);
+CREATE SEQUENCE IF NOT EXISTS settlements_id_seq;
+ALTER SEQUENCE settlements_id_seq OWNED BY settlements.id;
+CREATE TABLE IF NOT EXISTS migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key          TEXT PRIMARY KEY,
+	account      TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	created_at   BIGINT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS deliveries (
+	id   BIGSERIAL PRIMARY KEY,
+	dead BOOLEAN NOT NULL DEFAULT false,
+	data BYTEA NOT NULL
+);
+CREATE TABLE IF NOT EXISTS leases (
+	name       TEXT PRIMARY KEY,
+	owner      TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+`
+
+const postgresColumns = "account, order_id, state, created_at, data"
+
+// Postgres is a Store that keeps payments in a PostgreSQL database.
+type Postgres struct {
+	db *sql.DB
+}
+
+var _ Store = (*Postgres)(nil)
+
+// NewPostgres connects to the database at url and creates the tables if they do not exist.
+func NewPostgres(url string) (*Postgres, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(postgresSchema)
+	if err != nil {
+		db.Close() // nolint:errcheck
+		return nil, err
+	}
+	return &Postgres{db: db}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecord(row rowScanner) (*Record, error) {
+	var r Record
+	var createdAt int64
+	err := row.Scan(&r.Account, &r.OrderID, &r.State, &createdAt, &r.Data)
+	if err != nil {
+		return nil, err
+	}
+	r.CreatedAt = time.Unix(0, createdAt).UTC()
+	return &r, nil
+}
+
+func (s *Postgres) NextSequence() (seq uint64, err error) {
+	err = s.db.QueryRow("SELECT nextval('payments_index_seq')").Scan(&seq)
+	return
+}
+
+func (s *Postgres) Get(account string) (*Record, error) {
+	r, err := scanRecord(s.db.QueryRow("SELECT "+postgresColumns+" FROM payments WHERE account = $1", account))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+func (s *Postgres) Create(r *Record) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			"INSERT INTO payments ("+postgresColumns+", version) "+
+				"SELECT $1::text, $2::text, $3::text, $4::bigint, $5::jsonb, $6::bigint WHERE NOT EXISTS (SELECT 1 FROM archived_payments WHERE account = $1) "+
+				"ON CONFLICT (account) DO NOTHING",
+			r.Account, r.OrderID, r.State, r.CreatedAt.UnixNano(), string(r.Data), r.Version)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrExists
+		}
+		if k := r.IdempotencyKey; k != nil {
+			res, err = tx.Exec(
+				"INSERT INTO idempotency_keys (key, account, request_hash, created_at) VALUES ($1, $2, $3, $4) ON CONFLICT (key) DO NOTHING",
+				k.Key, k.Account, k.RequestHash, k.CreatedAt.UnixNano())
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return ErrKeyExists
+			}
+		}
+		return addDeliveries(tx, r.Deliveries)
+	})
+}
+
+func (s *Postgres) Put(r *Record) error {
+	query := "INSERT INTO payments (" + postgresColumns + ", version) VALUES ($1, $2, $3, $4, $5, $6) " +
+		"ON CONFLICT (account) DO UPDATE SET order_id = EXCLUDED.order_id, state = EXCLUDED.state, " +
+		"created_at = EXCLUDED.created_at, data = EXCLUDED.data, version = EXCLUDED.version"
+	if r.Version != 0 {
+		// Versioned records are only updated so that a stale save does not create a deleted or archived record again.
+		query = "UPDATE payments SET order_id = $2, state = $3, created_at = $4, data = $5, version = $6 " +
+			"WHERE account = $1 AND version = $6 - 1"
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(query, r.Account, r.OrderID, r.State, r.CreatedAt.UnixNano(), string(r.Data), r.Version)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrConflict
+		}
+		return addDeliveries(tx, r.Deliveries)
+	})
+}
+
+// inTx runs fn in a transaction. The transaction is rolled back if fn returns an error.
+func (s *Postgres) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback() // nolint:errcheck
+		return err
+	}
+	return tx.Commit()
+}
+
+// Archive saves JSON null as the data of the archived record if keepData is false.
+func (s *Postgres) Archive(account string, keepData bool) error {
+	_, err := s.db.Exec(
+		"WITH archived AS (DELETE FROM payments WHERE account = $1 RETURNING "+postgresColumns+") "+
+			"INSERT INTO archived_payments ("+postgresColumns+") "+
+			"SELECT account, order_id, state, created_at, CASE WHEN $2 THEN data ELSE 'null'::jsonb END FROM archived",
+		account, keepData)
+	return err
+}
+
+func (s *Postgres) Delete(account string) error {
+	_, err := s.db.Exec("DELETE FROM payments WHERE account = $1", account)
+	return err
+}
+
+func (s *Postgres) ForEach(fn func(*Record) error) error {
+	return s.query(func(r *Record) (bool, error) { return true, fn(r) }, "SELECT "+postgresColumns+" FROM payments")
+}
+
+func (s *Postgres) FindByOrderID(orderID string) ([]*Record, error) {
+	return s.find("order_id", orderID)
+}
+
+func (s *Postgres) FindByState(state string) ([]*Record, error) {
+	return s.find("state", state)
+}
+
+func (s *Postgres) find(column, value string) ([]*Record, error) {
+	ret := make([]*Record, 0)
+	err := s.query(func(r *Record) (bool, error) {
+		ret = append(ret, r)
+		return true, nil
+	}, "SELECT "+postgresColumns+" FROM payments WHERE "+column+" = $1 AND "+column+" <> '' ORDER BY account", value)
+	return ret, err
+}
+
+func (s *Postgres) List(opts ListOptions, fn func(*Record) (bool, error)) error {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if !opts.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= "+arg(opts.CreatedFrom.UnixNano()))
+	}
+	if !opts.CreatedTo.IsZero() {
+		where = append(where, "created_at < "+arg(opts.CreatedTo.UnixNano()))
+	}
+	op, order := ">", "ASC"
+	if opts.Descending {
+		op, order = "<", "DESC"
+	}
+	if opts.After != nil {
+		where = append(where, fmt.Sprintf("(created_at, account) %s (%s, %s)", op, arg(opts.After.CreatedAt.UnixNano()), arg(opts.After.Account)))
+	}
+	query := "SELECT " + postgresColumns + " FROM payments"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY created_at %s, account %s", order, order)
+	return s.query(fn, query, args...)
+}
+
+// query calls fn for each record returned from the query until fn returns false.
+func (s *Postgres) query(fn func(*Record) (bool, error), query string, args ...interface{}) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+		ok, err := fn(r)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Postgres) NextSettlementID() (id uint64, err error) {
+	err = s.db.QueryRow("SELECT nextval('settlements_id_seq')").Scan(&id)
+	return
+}
+
+func (s *Postgres) GetSettlement(id uint64) (*Settlement, error) {
+	st := Settlement{ID: id}
+	err := s.db.QueryRow("SELECT data FROM settlements WHERE id = $1", id).Scan(&st.Data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *Postgres) PutSettlement(st *Settlement) error {
+	_, err := s.db.Exec(
+		"INSERT INTO settlements (id, data) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data",
+		st.ID, string(st.Data))
+	return err
+}
+
+func (s *Postgres) ListSettlements(before uint64, fn func(*Settlement) (bool, error)) error {
+	query := "SELECT id, data FROM settlements ORDER BY id DESC"
+	var args []interface{}
+	if before != 0 {
+		query = "SELECT id, data FROM settlements WHERE id < $1 ORDER BY id DESC"
+		args = append(args, before)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var st Settlement
+		if err = rows.Scan(&st.ID, &st.Data); err != nil {
+			return err
+		}
+		ok, err := fn(&st)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Postgres) GetIdempotencyKey(key string) (*IdempotencyKey, error) {
+	k := IdempotencyKey{Key: key}
+	var createdAt int64
+	err := s.db.QueryRow("SELECT account, request_hash, created_at FROM idempotency_keys WHERE key = $1", key).Scan(&k.Account, &k.RequestHash, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.CreatedAt = time.Unix(0, createdAt).UTC()
+	return &k, nil
+}
+
+func (s *Postgres) PutIdempotencyKey(k *IdempotencyKey) error {
+	_, err := s.db.Exec(
+		"INSERT INTO idempotency_keys (key, account, request_hash, created_at) VALUES ($1, $2, $3, $4) "+
+			"ON CONFLICT (key) DO UPDATE SET account = EXCLUDED.account, request_hash = EXCLUDED.request_hash, created_at = EXCLUDED.created_at",
+		k.Key, k.Account, k.RequestHash, k.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *Postgres) DeleteIdempotencyKeys(createdBefore time.Time) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE created_at < $1", createdBefore.UnixNano())
+	return err
+}
+
+func addDeliveries(tx *sql.Tx, ds []*Delivery) error {
+	for _, d := range ds {
+		err := tx.QueryRow("INSERT INTO deliveries (dead, data) VALUES ($1, $2) RETURNING id", d.Dead, d.Data).Scan(&d.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Postgres) AddDeliveries(ds []*Delivery) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return addDeliveries(tx, ds)
+	})
+}
+
+func (s *Postgres) GetDelivery(id uint64) (*Delivery, error) {
+	d := Delivery{ID: id}
+	err := s.db.QueryRow("SELECT dead, data FROM deliveries WHERE id = $1", id).Scan(&d.Dead, &d.Data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *Postgres) UpdateDelivery(d *Delivery) error {
+	res, err := s.db.Exec("UPDATE deliveries SET dead = $2, data = $3 WHERE id = $1", d.ID, d.Dead, d.Data)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Postgres) DeleteDelivery(id uint64) error {
+	_, err := s.db.Exec("DELETE FROM deliveries WHERE id = $1", id)
+	return err
+}
+
+func (s *Postgres) ListDeliveries(dead bool, fn func(*Delivery) (bool, error)) error {
+	rows, err := s.db.Query("SELECT id, data FROM deliveries WHERE dead = $1 ORDER BY id", dead)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d := Delivery{Dead: dead}
+		if err = rows.Scan(&d.ID, &d.Data); err != nil {
+			return err
+		}
+		ok, err := fn(&d)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Postgres) Migrations() ([]int, error) {
+	rows, err := s.db.Query("SELECT version FROM migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var versions []int
+	for rows.Next() {
+		var v int
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func (s *Postgres) SetMigrated(version int, name string) error {
+	_, err := s.db.Exec("INSERT INTO migrations (version, name) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING", version, name)
+	return err
+}
+
+// AcquireLease uses the clock of the database server so that clock differences between instances do not matter.
+func (s *Postgres) AcquireLease(name, owner string, ttl time.Duration) (bool, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO leases (name, owner, expires_at) VALUES ($1, $2, now() + $3::bigint * interval '1 millisecond') "+
+			"ON CONFLICT (name) DO UPDATE SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at "+
+			"WHERE leases.owner = EXCLUDED.owner OR leases.expires_at < now()",
+		name, owner, ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *Postgres) ReleaseLease(name, owner string) error {
+	_, err := s.db.Exec("DELETE FROM leases WHERE name = $1 AND owner = $2", name, owner)
+	return err
+}
+
+func (s *Postgres) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,75 @@
+//go:build postgres
+// +build postgres
+
+package store
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests in this file are run with "go test -tags postgres".
+// They connect to the database in ACCEPTNANO_TEST_POSTGRES_URL and are skipped if it is not set.
+func testPostgresURL(t *testing.T) string {
+	url := os.Getenv("ACCEPTNANO_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("ACCEPTNANO_TEST_POSTGRES_URL is not set")
+	}
+	return url
+}
+
+func openTestPostgres(t *testing.T) *Postgres {
+	s, err := NewPostgres(testPostgresURL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	_, err = s.db.Exec("TRUNCATE payments, archived_payments, settlements, idempotency_keys, deliveries, migrations, leases RESTART IDENTITY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPostgres(t *testing.T) {
+	testStore(t, openTestPostgres(t))
+}
+
+func TestPostgresLease(t *testing.T) {
+	s := openTestPostgres(t)
+	const ttl = time.Second
+
+	ok, err := s.AcquireLease("leader", "i1", ttl)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = s.AcquireLease("leader", "i2", ttl)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	// Owner can renew the lease.
+	ok, err = s.AcquireLease("leader", "i1", ttl)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	// Other leases are independent.
+	ok, err = s.AcquireLease("other", "i2", ttl)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Only the owner can release the lease.
+	assert.NoError(t, s.ReleaseLease("leader", "i2"))
+	ok, err = s.AcquireLease("leader", "i2", ttl)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, s.ReleaseLease("leader", "i1"))
+	ok, err = s.AcquireLease("leader", "i2", ttl)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Lease can be taken over after it expires.
+	time.Sleep(ttl + 100*time.Millisecond)
+	ok, err = s.AcquireLease("leader", "i1", ttl)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
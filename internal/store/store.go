@@ -0,0 +1,157 @@
+// Package store contains the storage backends for payments.
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when there is no record with the given account.
+	ErrNotFound = errors.New("record not found")
+	// ErrExists is returned when creating a record with an account that is already saved.
+	ErrExists = errors.New("record already exists")
+	// ErrConflict is returned when updating a record that is changed after it is loaded.
+	ErrConflict = errors.New("record is changed by another update")
+	// ErrKeyExists is returned when creating a record with an idempotency key that is already saved.
+	ErrKeyExists = errors.New("idempotency key already exists")
+)
+
+// Record is a payment saved in a Store.
+// Data is the encoded payment and it is opaque to the store.
+// Other fields are indexed for lookups and listing.
+type Record struct {
+	// Primary key of the record.
+	Account string
+	// Values for secondary indexes. Empty values are not indexed.
+	OrderID string
+	State   string
+	// Records are listed in the order of creation time.
+	CreatedAt time.Time
+	Data      []byte
+	// Version of the record, incremented by the caller on every update. It must be encoded in Data too.
+	// If it is not zero, Put only updates the record if the saved version is the previous one.
+	Version uint64
+	// Saved in the same transaction when the record is created with Create.
+	IdempotencyKey *IdempotencyKey
+	// Queued in the same transaction when the record is saved with Create or Put.
+	// IDs of the deliveries are set by the store.
+	Deliveries []*Delivery
+}
+
+// IdempotencyKey maps a key sent by a client to the record created with it.
+// Keys are saved in JSON format in bbolt.
+type IdempotencyKey struct {
+	Key string `json:"-"`
+	// Account of the created record.
+	Account string `json:"account"`
+	// Hash of the request parameters.
+	RequestHash string    `json:"requestHash"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Delivery is a notification queued in a Store.
+// Data is the encoded notification and it is opaque to the store.
+type Delivery struct {
+	// Set by the store when the delivery is queued. Deliveries are listed in the order of ID.
+	ID uint64
+	// Dead deliveries are kept in a separate queue and they are not retried.
+	Dead bool
+	Data []byte
+}
+
+// Cursor is the position of a record in listing order.
+type Cursor struct {
+	CreatedAt time.Time
+	Account   string
+}
+
+// ListOptions contains the parameters for listing records.
+type ListOptions struct {
+	// Records created in [CreatedFrom, CreatedTo) are listed. Zero values mean no limit.
+	CreatedFrom, CreatedTo time.Time
+	// Newest records are listed first if set.
+	Descending bool
+	// Listing continues after this position if set.
+	After *Cursor
+}
+
+// Settlement is a batch of payments sent to the merchant account, saved in a Store.
+// Data is the encoded settlement and it is opaque to the store.
+type Settlement struct {
+	// Primary key of the settlement. Settlements are listed in the order of ID.
+	ID   uint64
+	Data []byte
+}
+
+// Store is a persistent storage for payments.
+//
+// Records returned from Get, Find* and List methods are only guaranteed to have Account and Data fields set.
+// Callback functions must not modify the store.
+// Data of the records passed to callback functions is only valid until the function returns.
+type Store interface {
+	// NextSequence returns a unique number to be used for generating the account of a new payment.
+	NextSequence() (uint64, error)
+	// Get returns the record with the account. Returns ErrNotFound if there is no record.
+	Get(account string) (*Record, error)
+	// Create saves a new record. Returns ErrExists if the account is already saved
+	// and ErrKeyExists if the idempotency key of the record is already saved.
+	Create(r *Record) error
+	// Put creates or updates a record. Idempotency key of the record is ignored.
+	// If r.Version is not zero, only the saved record with version r.Version-1 is updated.
+	// Returns ErrConflict if there is no such record, e.g. the record is updated by another writer or archived.
+	Put(r *Record) error
+	// Archive moves the record to the archive. Archived records are not returned from other methods
+	// but their accounts cannot be created again.
+	// If keepData is false, only the account is kept in the archive. It is used when the data is archived elsewhere.
+	Archive(account string, keepData bool) error
+	// Delete removes the record. Deleting a missing record is not an error.
+	Delete(account string) error
+	// ForEach calls fn for every record in unspecified order.
+	ForEach(fn func(*Record) error) error
+	// FindByOrderID returns records with the given order ID.
+	FindByOrderID(orderID string) ([]*Record, error)
+	// FindByState returns records with the given state.
+	FindByState(state string) ([]*Record, error)
+	// List calls fn for records in creation order. Listing stops when fn returns false.
+	// All records are read from a consistent snapshot of the store.
+	List(opts ListOptions, fn func(*Record) (bool, error)) error
+	// NextSettlementID returns a unique number, greater than the previous ones, for a new settlement.
+	NextSettlementID() (uint64, error)
+	// GetSettlement returns the settlement with the ID. Returns ErrNotFound if there is no settlement.
+	GetSettlement(id uint64) (*Settlement, error)
+	// PutSettlement creates or updates a settlement.
+	PutSettlement(st *Settlement) error
+	// ListSettlements calls fn for settlements with IDs lower than before, newest first. Zero before means no limit.
+	// Listing stops when fn returns false.
+	ListSettlements(before uint64, fn func(*Settlement) (bool, error)) error
+	// GetIdempotencyKey returns the key. Returns ErrNotFound if there is no key.
+	GetIdempotencyKey(key string) (*IdempotencyKey, error)
+	// PutIdempotencyKey creates or updates a key.
+	PutIdempotencyKey(k *IdempotencyKey) error
+	// DeleteIdempotencyKeys deletes the keys created before t.
+	DeleteIdempotencyKeys(createdBefore time.Time) error
+	// AddDeliveries queues the deliveries and sets their IDs.
+	AddDeliveries(ds []*Delivery) error
+	// GetDelivery returns the delivery with the ID. Returns ErrNotFound if there is no delivery.
+	GetDelivery(id uint64) (*Delivery, error)
+	// UpdateDelivery saves an existing delivery. It is moved between queues if Dead is changed.
+	// Returns ErrNotFound if the delivery is deleted.
+	UpdateDelivery(d *Delivery) error
+	// DeleteDelivery removes the delivery. Deleting a missing delivery is not an error.
+	DeleteDelivery(id uint64) error
+	// ListDeliveries calls fn for the deliveries in the queue, or in the dead queue if dead is set, in the order of ID.
+	// Listing stops when fn returns false.
+	ListDeliveries(dead bool, fn func(*Delivery) (bool, error)) error
+	// Migrations returns the versions of the migrations applied to the store in increasing order.
+	Migrations() ([]int, error)
+	// SetMigrated records that the migration with the version is applied.
+	SetMigrated(version int, name string) error
+	// AcquireLease acquires or renews the named lease for owner until ttl passes.
+	// Returns false if the lease is held by another owner.
+	AcquireLease(name, owner string, ttl time.Duration) (bool, error)
+	// ReleaseLease releases the lease if it is held by owner.
+	ReleaseLease(name, owner string) error
+	// Close releases the resources held by the store.
+	Close() error
+}
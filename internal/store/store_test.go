@@ -0,0 +1,271 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testData is saved in Data field of the test records.
+type testData struct {
+	OrderID   string    `json:"orderId"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"createdAt"`
+	Version   uint64    `json:"version"`
+}
+
+func newTestRecord(account, orderID, state string, createdAt time.Time) *Record {
+	data, _ := json.Marshal(testData{orderID, state, createdAt, 0})
+	return &Record{Account: account, OrderID: orderID, State: state, CreatedAt: createdAt, Data: data}
+}
+
+func decodeTestRecord(r *Record) error {
+	var d testData
+	err := json.Unmarshal(r.Data, &d)
+	if err != nil {
+		return err
+	}
+	r.OrderID, r.State, r.CreatedAt, r.Version = d.OrderID, d.State, d.CreatedAt, d.Version
+	return nil
+}
+
+// newVersionedTestRecord returns a record that is saved with version.
+func newVersionedTestRecord(account string, createdAt time.Time, version uint64) *Record {
+	data, _ := json.Marshal(testData{CreatedAt: createdAt, Version: version})
+	return &Record{Account: account, CreatedAt: createdAt, Data: data, Version: version}
+}
+
+func accounts(records []*Record) []string {
+	ret := make([]string, 0, len(records))
+	for _, r := range records {
+		ret = append(ret, r.Account)
+	}
+	return ret
+}
+
+func list(t *testing.T, s Store, opts ListOptions) []string {
+	var ret []string
+	err := s.List(opts, func(r *Record) (bool, error) {
+		ret = append(ret, r.Account)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return ret
+}
+
+func listDeliveries(t *testing.T, s Store, dead bool) []string {
+	var ret []string
+	err := s.ListDeliveries(dead, func(d *Delivery) (bool, error) {
+		ret = append(ret, string(d.Data))
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return ret
+}
+
+func listSettlements(t *testing.T, s Store, before uint64) []uint64 {
+	var ret []uint64
+	err := s.ListSettlements(before, func(st *Settlement) (bool, error) {
+		ret = append(ret, st.ID)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	return ret
+}
+
+// testStore runs the common tests on an empty store.
+func testStore(t *testing.T, s Store) {
+	seq1, err := s.NextSequence()
+	assert.NoError(t, err)
+	seq2, err := s.NextSequence()
+	assert.NoError(t, err)
+	assert.Greater(t, seq2, seq1)
+
+	_, err = s.Get("a1")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Times are created with nanoseconds to check that precision is not lost.
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 1, time.UTC)
+	for i := 1; i <= 5; i++ {
+		orderID := ""
+		if i%2 == 0 {
+			orderID = "even"
+		}
+		assert.NoError(t, s.Create(newTestRecord(fmt.Sprintf("a%d", i), orderID, "", t0.Add(time.Duration(i)*time.Hour))))
+	}
+	assert.Equal(t, ErrExists, s.Create(newTestRecord("a1", "", "", t0)))
+
+	r, err := s.Get("a3")
+	assert.NoError(t, err)
+	assert.Equal(t, "a3", r.Account)
+	var d testData
+	assert.NoError(t, json.Unmarshal(r.Data, &d))
+	assert.True(t, d.CreatedAt.Equal(t0.Add(3*time.Hour)))
+
+	var all []string
+	assert.NoError(t, s.ForEach(func(r *Record) error {
+		all = append(all, r.Account)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"a1", "a2", "a3", "a4", "a5"}, all)
+
+	found, err := s.FindByOrderID("even")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a2", "a4"}, accounts(found))
+
+	// Updating indexed fields moves the record in indexes.
+	assert.NoError(t, s.Put(newTestRecord("a2", "", "paid", t0.Add(2*time.Hour))))
+	found, err = s.FindByOrderID("even")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a4"}, accounts(found))
+	found, err = s.FindByState("paid")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a2"}, accounts(found))
+	found, err = s.FindByState("")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	// Put creates missing records.
+	assert.NoError(t, s.Put(newTestRecord("a6", "", "", t0.Add(6*time.Hour))))
+	_, err = s.Get("a6")
+	assert.NoError(t, err)
+
+	// Versioned updates fail if the record is updated by another writer.
+	assert.NoError(t, s.Put(newVersionedTestRecord("a3", t0.Add(3*time.Hour), 1)))
+	assert.NoError(t, s.Put(newVersionedTestRecord("a3", t0.Add(3*time.Hour), 2)))
+	assert.Equal(t, ErrConflict, s.Put(newVersionedTestRecord("a3", t0.Add(3*time.Hour), 2)))
+	assert.Equal(t, ErrConflict, s.Put(newVersionedTestRecord("a3", t0.Add(3*time.Hour), 4)))
+	r, err = s.Get("a3")
+	assert.NoError(t, err)
+	assert.NoError(t, decodeTestRecord(r))
+	assert.Equal(t, uint64(2), r.Version)
+
+	assert.Equal(t, []string{"a1", "a2", "a3", "a4", "a5", "a6"}, list(t, s, ListOptions{}))
+	assert.Equal(t, []string{"a6", "a5", "a4", "a3", "a2", "a1"}, list(t, s, ListOptions{Descending: true}))
+	assert.Equal(t, []string{"a2", "a3"}, list(t, s, ListOptions{
+		CreatedFrom: t0.Add(2 * time.Hour),
+		CreatedTo:   t0.Add(4 * time.Hour),
+	}))
+	assert.Equal(t, []string{"a3", "a2"}, list(t, s, ListOptions{
+		CreatedFrom: t0.Add(2 * time.Hour),
+		CreatedTo:   t0.Add(4 * time.Hour),
+		Descending:  true,
+	}))
+	after := &Cursor{CreatedAt: t0.Add(3 * time.Hour), Account: "a3"}
+	assert.Equal(t, []string{"a4", "a5", "a6"}, list(t, s, ListOptions{After: after}))
+	assert.Equal(t, []string{"a2", "a1"}, list(t, s, ListOptions{After: after, Descending: true}))
+	assert.Equal(t, []string{"a4"}, list(t, s, ListOptions{After: after, CreatedTo: t0.Add(5 * time.Hour)}))
+
+	assert.NoError(t, s.Archive("a4", true))
+	assert.NoError(t, s.Archive("a4", true))
+	_, err = s.Get("a4")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrExists, s.Create(newTestRecord("a4", "", "", t0)))
+	// Versioned updates do not create archived records again.
+	assert.Equal(t, ErrConflict, s.Put(newVersionedTestRecord("a4", t0.Add(4*time.Hour), 2)))
+	_, err = s.Get("a4")
+	assert.Equal(t, ErrNotFound, err)
+	found, err = s.FindByOrderID("even")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+	assert.NoError(t, s.Delete("a5"))
+	assert.NoError(t, s.Delete("a5"))
+	_, err = s.Get("a5")
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, s.Archive("a6", false))
+	_, err = s.Get("a6")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrExists, s.Create(newTestRecord("a6", "", "", t0)))
+	assert.Equal(t, []string{"a1", "a2", "a3"}, list(t, s, ListOptions{}))
+
+	versions, err := s.Migrations()
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+	assert.NoError(t, s.SetMigrated(2, "second"))
+	assert.NoError(t, s.SetMigrated(1, "first"))
+	assert.NoError(t, s.SetMigrated(1, "first"))
+	versions, err = s.Migrations()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, versions)
+
+	_, err = s.GetSettlement(1)
+	assert.Equal(t, ErrNotFound, err)
+	var settlementIDs []uint64
+	for i := 0; i < 3; i++ {
+		id, err := s.NextSettlementID()
+		assert.NoError(t, err)
+		assert.NoError(t, s.PutSettlement(&Settlement{ID: id, Data: []byte(`{"status":"open"}`)}))
+		settlementIDs = append(settlementIDs, id)
+	}
+	assert.Less(t, settlementIDs[0], settlementIDs[1])
+	assert.NoError(t, s.PutSettlement(&Settlement{ID: settlementIDs[1], Data: []byte(`{"status":"sent"}`)}))
+	st, err := s.GetSettlement(settlementIDs[1])
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"status":"sent"}`, string(st.Data))
+	assert.Equal(t, []uint64{settlementIDs[2], settlementIDs[1], settlementIDs[0]}, listSettlements(t, s, 0))
+	assert.Equal(t, []uint64{settlementIDs[0]}, listSettlements(t, s, settlementIDs[1]))
+	assert.Equal(t, []uint64{settlementIDs[2], settlementIDs[1], settlementIDs[0]}, listSettlements(t, s, settlementIDs[2]+1))
+
+	// Idempotency key and deliveries are saved together with the record.
+	_, err = s.GetIdempotencyKey("k1")
+	assert.Equal(t, ErrNotFound, err)
+	r = newTestRecord("a7", "", "", t0.Add(7*time.Hour))
+	r.IdempotencyKey = &IdempotencyKey{Key: "k1", Account: "a7", RequestHash: "h1", CreatedAt: t0}
+	r.Deliveries = []*Delivery{{Data: []byte("d1")}, {Data: []byte("d2")}}
+	assert.NoError(t, s.Create(r))
+	assert.Less(t, r.Deliveries[0].ID, r.Deliveries[1].ID)
+	k, err := s.GetIdempotencyKey("k1")
+	assert.NoError(t, err)
+	assert.Equal(t, "a7", k.Account)
+	assert.Equal(t, "h1", k.RequestHash)
+	assert.True(t, k.CreatedAt.Equal(t0))
+	// Nothing is saved if the key exists.
+	r = newTestRecord("a8", "", "", t0.Add(8*time.Hour))
+	r.IdempotencyKey = &IdempotencyKey{Key: "k1", Account: "a8", RequestHash: "h2", CreatedAt: t0}
+	r.Deliveries = []*Delivery{{Data: []byte("d3")}}
+	assert.Equal(t, ErrKeyExists, s.Create(r))
+	_, err = s.Get("a8")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []string{"d1", "d2"}, listDeliveries(t, s, false))
+	r = newTestRecord("a7", "", "", t0.Add(7*time.Hour))
+	r.Deliveries = []*Delivery{{Data: []byte("d3")}}
+	assert.NoError(t, s.Put(r))
+	assert.Equal(t, []string{"d1", "d2", "d3"}, listDeliveries(t, s, false))
+
+	assert.NoError(t, s.PutIdempotencyKey(&IdempotencyKey{Key: "k2", Account: "a1", CreatedAt: t0.Add(time.Hour)}))
+	assert.NoError(t, s.DeleteIdempotencyKeys(t0.Add(time.Minute)))
+	_, err = s.GetIdempotencyKey("k1")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.GetIdempotencyKey("k2")
+	assert.NoError(t, err)
+
+	dead := &Delivery{Dead: true, Data: []byte("d4")}
+	assert.NoError(t, s.AddDeliveries([]*Delivery{dead}))
+	assert.Equal(t, []string{"d4"}, listDeliveries(t, s, true))
+	d1 := r.Deliveries[0]
+	d1.Dead = true
+	d1.Data = []byte("d3 failed")
+	assert.NoError(t, s.UpdateDelivery(d1))
+	assert.Equal(t, []string{"d1", "d2"}, listDeliveries(t, s, false))
+	assert.Equal(t, []string{"d3 failed", "d4"}, listDeliveries(t, s, true))
+	got, err := s.GetDelivery(d1.ID)
+	assert.NoError(t, err)
+	assert.True(t, got.Dead)
+	assert.Equal(t, "d3 failed", string(got.Data))
+	assert.NoError(t, s.DeleteDelivery(dead.ID))
+	assert.NoError(t, s.DeleteDelivery(dead.ID))
+	_, err = s.GetDelivery(dead.ID)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, s.UpdateDelivery(dead))
+	assert.Equal(t, []string{"d3 failed"}, listDeliveries(t, s, true))
+
+	var limited []string
+	assert.NoError(t, s.List(ListOptions{}, func(r *Record) (bool, error) {
+		limited = append(limited, r.Account)
+		return len(limited) < 2, nil
+	}))
+	assert.Equal(t, []string{"a1", "a2"}, limited)
+}
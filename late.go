@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/cenkalti/log"
+)
+
+// runLatePaymentChecker periodically checks expired and cancelled payments for funds sent after expiration
+// until stop is closed.
+func runLatePaymentChecker(stop chan struct{}) {
+	defer workersWG.Done()
+	for {
+		select {
+		case <-time.After(config.LatePaymentCheckInterval):
+			checkLatePayments(stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func checkLatePayments(stop chan struct{}) {
+	log.Debugln("checking late payments")
+	var payments []*Payment
+	opts := store.ListOptions{CreatedFrom: time.Now().Add(-config.LatePaymentCheckPeriod)}
+	err := paymentStore.List(opts, func(r *store.Record) (bool, error) {
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			log.Error(err)
+			return true, nil
+		}
+		switch {
+		case p.Status == StatusExpired, p.Status == StatusCancelled:
+			payments = append(payments, p)
+		case p.timedOut() && p.Status.canTransition(StatusExpired):
+			// Payments that are timed out while the server is not running have not been marked as expired yet.
+			payments = append(payments, p)
+		}
+		return true, nil
+	})
+	if err != nil {
+		log.Errorln("cannot load expired payments:", err)
+		return
+	}
+	for _, p := range payments {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if p.Status.canTransition(StatusExpired) {
+			p.expire()
+		}
+		err = p.checkLateOnce()
+		if err != nil {
+			log.Errorf("error checking late payment %s: %s", p.account, err)
+		}
+	}
+}
+
+func (p *Payment) checkLateOnce() error {
+	locks.Lock(p.account)
+	defer locks.Unlock(p.account)
+
+	err := p.reload()
+	if err != nil {
+		return err
+	}
+	if !p.Status.canTransition(StatusLatePaid) {
+		return nil
+	}
+	return p.checkLate(shutdownCtx)
+}
+
+// checkLate marks the payment as late paid if funds arrived after the payment is expired or cancelled.
+// Balance of the payment is not updated after it is expired or cancelled so it is the amount received before that.
+func (p *Payment) checkLate(ctx context.Context) error {
+	totalAmount, _, err := p.fetchFunds(ctx)
+	if err != nil {
+		return err
+	}
+	if !totalAmount.GreaterThan(p.Balance) {
+		return nil
+	}
+	log.Noticef("late payment detected for %s: %s", p.account, units.RawToNano(totalAmount.Sub(p.Balance)))
+	p.Balance = totalAmount
+	if p.Balance.GreaterThan(p.Amount) {
+		p.Overpaid = p.Balance.Sub(p.Amount)
+	}
+	err = p.setStatus(StatusLatePaid)
+	if err != nil {
+		return err
+	}
+	p.LatePaidAt = now()
+	err = p.publishEvent(EventLatePaid)
+	if err != nil {
+		return err
+	}
+	err = p.Save()
+	if err != nil {
+		return err
+	}
+	go verifications.Publish(PaymentVerified{Payment: *p})
+	return nil
+}
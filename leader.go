@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/cenkalti/log"
+)
+
+const leaderLeaseName = "leader"
+
+var errNotLeader = errors.New("this instance is not the leader, retry on the leader instance")
+
+// leading is true while this instance is allowed to check payments. Guarded by checkersM.
+// It is always true when HighAvailability is disabled.
+var leading bool
+
+// instanceID identifies this process as the owner of the leader lease.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b) // nolint:errcheck
+	return hostname + "-" + hex.EncodeToString(b)
+}
+
+// isLeader returns true if this instance is allowed to check payments and send funds.
+func isLeader() bool {
+	checkersM.Lock()
+	defer checkersM.Unlock()
+	return leading
+}
+
+// checkLeaderLease renews the leader lease before a block is published in high availability mode.
+// An instance that has lost the lease may not have stepped down yet. It must not send funds
+// while the new leader is processing the same payments.
+func checkLeaderLease() error {
+	if !config.HighAvailability {
+		return nil
+	}
+	if !isLeader() {
+		return errNotLeader
+	}
+	acquired, err := paymentStore.AcquireLease(leaderLeaseName, instanceID, config.LeaderLeaseDuration)
+	if err != nil {
+		return err
+	}
+	if !acquired {
+		return errNotLeader
+	}
+	return nil
+}
+
+// acquireCommandLease takes the leader lease for a command that sends funds in high availability mode.
+// Returned function releases the lease.
+func acquireCommandLease() (release func(), err error) {
+	if !config.HighAvailability {
+		return func() {}, nil
+	}
+	acquired, err := paymentStore.AcquireLease(leaderLeaseName, instanceID, config.LeaderLeaseDuration)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, errors.New("leader lease is held by another instance, commands that send funds cannot run while it is the leader")
+	}
+	checkersM.Lock()
+	leading = true
+	checkersM.Unlock()
+	return func() {
+		if err := paymentStore.ReleaseLease(leaderLeaseName, instanceID); err != nil {
+			log.Errorln("cannot release leader lease:", err)
+		}
+	}, nil
+}
+
+// runLeaderElection tries to acquire the leader lease until stopCheckPayments is closed.
+// Only the instance holding the lease checks payments and runs the late payment checker.
+// Other instances keep serving the API. Payments created on them are picked up by the leader with periodic scans.
+func runLeaderElection() {
+	defer workersWG.Done()
+	var stop chan struct{}
+	var renewedAt time.Time
+	renewInterval := config.LeaderLeaseDuration / 3
+	defer func() {
+		if stop == nil {
+			return
+		}
+		stepDown(stop)
+		if err := paymentStore.ReleaseLease(leaderLeaseName, instanceID); err != nil {
+			log.Errorln("cannot release leader lease:", err)
+		}
+	}()
+	for {
+		acquired, err := paymentStore.AcquireLease(leaderLeaseName, instanceID, config.LeaderLeaseDuration)
+		switch {
+		case err != nil:
+			log.Errorln("cannot acquire leader lease:", err)
+			// Stop checking payments before the lease may expire and be taken by another instance.
+			if stop != nil && time.Since(renewedAt) > config.LeaderLeaseDuration-renewInterval {
+				stepDown(stop)
+				stop = nil
+			}
+		case acquired:
+			renewedAt = time.Now()
+			if stop == nil {
+				stop = make(chan struct{})
+				becomeLeader(stop)
+			}
+		case stop != nil:
+			log.Warningln("leader lease is taken by another instance")
+			stepDown(stop)
+			stop = nil
+		}
+		select {
+		case <-time.After(renewInterval):
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+// becomeLeader starts the jobs that must be run on a single instance. The jobs are stopped when stop is closed.
+func becomeLeader(stop chan struct{}) {
+	log.Noticeln("became leader:", instanceID)
+	checkersM.Lock()
+	leading = true
+	checkersM.Unlock()
+
+	workersWG.Add(1)
+	go runActivePaymentScanner(stop)
+
+	workersWG.Add(1)
+	go runDeliveryWorker(stop)
+
+	if config.LatePaymentCheckInterval > 0 {
+		workersWG.Add(1)
+		go runLatePaymentChecker(stop)
+	}
+
+	if config.ArchiveAfter > 0 {
+		workersWG.Add(1)
+		go runArchiver(stop)
+	}
+
+	if config.SweepInterval > 0 {
+		workersWG.Add(1)
+		go runSweeper(stop)
+	}
+
+	if config.SettlementInterval > 0 {
+		workersWG.Add(1)
+		go runSettlementScheduler(stop)
+	}
+}
+
+// stepDown stops checking payments.
+func stepDown(stop chan struct{}) {
+	log.Noticeln("stepping down from leader:", instanceID)
+	close(stop)
+	checkersM.Lock()
+	defer checkersM.Unlock()
+	leading = false
+	for account, c := range checkers {
+		close(c)
+		delete(checkers, account)
+	}
+}
+
+// runActivePaymentScanner starts checking active payments periodically.
+// Only payments created within the max allowed duration are scanned because older ones cannot be active.
+func runActivePaymentScanner(stop chan struct{}) {
+	defer workersWG.Done()
+	for {
+		maxDuration := config.AllowedDuration
+		if config.MaxAllowedDuration > maxDuration {
+			maxDuration = config.MaxAllowedDuration
+		}
+		var payments []*Payment
+		err := paymentStore.List(store.ListOptions{CreatedFrom: time.Now().Add(-maxDuration)}, func(r *store.Record) (bool, error) {
+			p, err := decodePayment(r.Account, r.Data)
+			if err != nil {
+				log.Error(err)
+				return true, nil
+			}
+			payments = append(payments, p)
+			return true, nil
+		})
+		if err != nil {
+			log.Errorln("cannot scan active payments:", err)
+		}
+		for _, p := range payments {
+			p.StartChecking()
+		}
+		select {
+		case <-time.After(config.LeaderScanInterval):
+		case <-stop:
+			return
+		}
+	}
+}
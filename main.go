@@ -9,10 +9,12 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/accept-nano/accept-nano/internal/hub"
 	"github.com/accept-nano/accept-nano/internal/nano"
 	"github.com/accept-nano/accept-nano/internal/price"
+	"github.com/accept-nano/accept-nano/internal/store"
 	"github.com/accept-nano/accept-nano/internal/subscriber"
 	"github.com/cenkalti/log"
 	"github.com/ulule/limiter/v3"
@@ -20,7 +22,9 @@ import (
 	"go.etcd.io/bbolt"
 )
 
-const paymentsBucket = "payments"
+const workCacheBucket = "workCache"
+
+const dbLockTimeout = 5 * time.Second
 
 // These variables are set by goreleaser on build.
 var (
@@ -35,16 +39,25 @@ var (
 	versionFlag       = flag.Bool("version", false, "display version and exit")
 	config            Config
 	db                *bbolt.DB
+	paymentStore      store.Store
 	server            http.Server
 	rateLimiter       *limiter.Limiter
 	node              *nano.Node
+	workProvider      nano.WorkProvider
 	stopCheckPayments = make(chan struct{})
 	checkPaymentWG    sync.WaitGroup
+	workersWG         sync.WaitGroup
 	verifications     hub.Hub
 	priceAPI          *price.API
 	subs              *subscriber.Subscriber
 )
 
+// Cancelled on shutdown to abort long running operations such as proof of work generation.
+var shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
+
+// Base context of HTTP requests. Cancelled if unfinished requests do not complete in ShutdownTimeout.
+var requestsCtx, cancelRequests = context.WithCancel(context.Background())
+
 func versionString() string {
 	const shaLen = 7
 	if len(commit) > shaLen {
@@ -79,6 +92,33 @@ func main() {
 		log.SetLevel(log.DEBUG)
 	}
 
+	if config.HighAvailability && config.DatabaseBackend != "postgres" {
+		log.Fatal("HighAvailability requires postgres DatabaseBackend")
+	}
+
+	err = validateSplitRules(config.SplitRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = validateWebhookEndpoints()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range webhookEndpoints() {
+		if e.Secret == "" {
+			log.Warningf("empty secret for %s, notifications will not be signed", e.URL)
+		}
+	}
+
+	if config.LatePaymentCheckInterval > 0 && config.ArchiveAfter > 0 && config.ArchiveAfter < config.LatePaymentCheckPeriod {
+		log.Warning("ArchiveAfter is shorter than LatePaymentCheckPeriod, late payments are not going to be detected for archived payments")
+	}
+
+	if config.SweepInterval > 0 && config.SweepMaxAge > 0 && config.SweepMaxAge <= config.LatePaymentCheckPeriod {
+		log.Warning("SweepMaxAge is not longer than LatePaymentCheckPeriod, expired and cancelled payments are not going to be swept")
+	}
+
 	if config.CoinmarketcapAPIKey == "" {
 		log.Warning("empty CoinmarketcapAPIKey in config, fiat conversions will not work")
 	}
@@ -89,33 +129,129 @@ func main() {
 	}
 
 	rateLimiter = limiter.New(memory.NewStore(), rate, limiter.WithTrustForwardHeader(true))
-	node = nano.New(config.NodeURL, config.NodeTimeout, config.NodeSleepBetweenRequests, config.NodeAuthorizationHeader, config.NodeAPIKeyHeader)
-	defer node.Close()
+	node = nano.New(config.nodeEndpoints(), config.NodeTimeout, config.nodeRateLimit(), nano.CircuitBreaker{MaxFailures: config.NodeMaxFailures, OpenDuration: config.NodeRetryAfter})
+	workProvider, err = newWorkProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
 	notificationClient.Timeout = config.NotificationRequestTimeout
 	priceAPI = price.NewAPI(config.CoinmarketcapAPIKey, config.CoinmarketcapRequestTimeout, config.CoinmarketcapCacheDuration)
 
+	if *restorePath != "" {
+		// Restore before opening the database because the current database may be corrupt or incompatible.
+		err = restoreBackup(*restorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Debugln("opening db:", config.DatabasePath)
-	db, err = bbolt.Open(config.DatabasePath, 0600, nil)
+	var dbOptions *bbolt.Options
+	if commandMode() {
+		// Do not wait forever if the server is running and holding the lock on the database file.
+		dbOptions = &bbolt.Options{Timeout: dbLockTimeout}
+	}
+	db, err = bbolt.Open(config.DatabasePath, 0600, dbOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Debugln("db has been opened successfully")
 
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, txErr := tx.CreateBucketIfNotExists([]byte(paymentsBucket))
+		_, txErr := tx.CreateBucketIfNotExists([]byte(workCacheBucket))
 		return txErr
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Check existing payments.
-	payments, err := LoadActivePayments()
+	paymentStore, err = openPaymentStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.DatabaseBackend == "postgres" {
+		// Older versions kept them in the local database.
+		err = moveLocalDeliveries()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = moveLocalIdempotencyKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = runMigrations(paymentStore)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, p := range payments {
-		p.StartChecking()
+
+	if commandMode() {
+		err = runCommand()
+		if err2 := paymentStore.Close(); err2 != nil {
+			log.Error(err2)
+		}
+		if err2 := db.Close(); err2 != nil {
+			log.Error(err2)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	workersWG.Add(1)
+	go runIdempotencyKeyCleaner()
+
+	workersWG.Add(1)
+	go runWorkPrecomputer()
+
+	if config.BackupDir != "" {
+		workersWG.Add(1)
+		go runBackupScheduler()
+	}
+
+	if config.HighAvailability {
+		workersWG.Add(1)
+		go runLeaderElection()
+	} else {
+		checkersM.Lock()
+		leading = true
+		checkersM.Unlock()
+
+		workersWG.Add(1)
+		go runDeliveryWorker(stopCheckPayments)
+
+		if config.LatePaymentCheckInterval > 0 {
+			workersWG.Add(1)
+			go runLatePaymentChecker(stopCheckPayments)
+		}
+
+		if config.ArchiveAfter > 0 {
+			workersWG.Add(1)
+			go runArchiver(stopCheckPayments)
+		}
+
+		if config.SweepInterval > 0 {
+			workersWG.Add(1)
+			go runSweeper(stopCheckPayments)
+		}
+
+		if config.SettlementInterval > 0 {
+			workersWG.Add(1)
+			go runSettlementScheduler(stopCheckPayments)
+		}
+
+		// Check existing payments.
+		payments, err := LoadActivePayments()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range payments {
+			p.StartChecking()
+		}
 	}
 
 	if !config.DisableWebsocket && config.NodeWebsocketURL != "" {
@@ -131,6 +267,7 @@ func main() {
 	<-stop
 
 	close(stopCheckPayments)
+	cancelShutdown()
 
 	shutdownTimeout := config.ShutdownTimeout
 	log.Noticeln("shutting down with timeout:", shutdownTimeout)
@@ -142,8 +279,15 @@ func main() {
 	if err != nil {
 		log.Errorln("shutdown error:", err)
 	}
+	cancelRequests()
 
 	checkPaymentWG.Wait()
+	workersWG.Wait()
+
+	err = paymentStore.Close()
+	if err != nil {
+		log.Error(err)
+	}
 
 	err = db.Close()
 	if err != nil {
@@ -151,8 +295,42 @@ func main() {
 	}
 }
 
+// openPaymentStore returns the store in config for saving payments.
+func openPaymentStore() (store.Store, error) {
+	switch config.DatabaseBackend {
+	case "", "bolt":
+		return store.NewBolt(db, decodeRecord)
+	case "postgres":
+		log.Debugln("connecting to postgres")
+		return store.NewPostgres(config.PostgresURL)
+	default:
+		return nil, fmt.Errorf("invalid DatabaseBackend: %q", config.DatabaseBackend)
+	}
+}
+
+// newWorkProvider returns the provider in config for generating proof of work.
+func newWorkProvider() (nano.WorkProvider, error) {
+	switch config.WorkProvider {
+	case "", "local":
+		return nano.LocalWork{}, nil
+	case "node":
+		return node, nil
+	case "servers":
+		if len(config.WorkServerURLs) == 0 {
+			return nil, fmt.Errorf("WorkServerURLs must be set for %q WorkProvider", config.WorkProvider)
+		}
+		return nano.NewWorkServers(config.WorkServerURLs, config.WorkServerTimeout, node), nil
+	default:
+		return nil, fmt.Errorf("invalid WorkProvider: %q", config.WorkProvider)
+	}
+}
+
 func runChecker() {
 	for account := range subs.Confirmations {
+		if !isLeader() {
+			// Payment is checked by the leader instance.
+			continue
+		}
 		p, err := LoadPayment(account)
 		if err == errPaymentNotFound {
 			continue
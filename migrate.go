@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/cenkalti/log"
+)
+
+// paymentSchemaVersion is the version of the Payment records saved by this version of the program.
+// It must be equal to the version of the last migration.
+const paymentSchemaVersion = 1
+
+// migration updates the payments saved with an older schema version.
+type migration struct {
+	version int
+	name    string
+	// migrate is called for payments with a schema version lower than the version of the migration.
+	migrate func(p *Payment) error
+}
+
+// migrations are run in order. New migrations must be appended with an incremented version.
+var migrations = []migration{
+	{1, "save status of legacy payments", func(p *Payment) error {
+		// Status of the payments saved before Status field is introduced is derived on load.
+		// Saving the payment persists the derived status.
+		return nil
+	}},
+}
+
+// runMigrations migrates the payments in store to the current schema version.
+// Returns an error if the store is migrated by a newer version of the program.
+func runMigrations(s store.Store) error {
+	applied, err := s.Migrations()
+	if err != nil {
+		return err
+	}
+	isApplied := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		if v > paymentSchemaVersion {
+			return fmt.Errorf("database schema version %d is newer than supported version %d, upgrade accept-nano", v, paymentSchemaVersion)
+		}
+		isApplied[v] = true
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if !isApplied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	log.Noticef("running %d database migrations", len(pending))
+	// Accounts are collected first because the store cannot be modified while iterating.
+	var accounts []string
+	err = s.ForEach(func(r *store.Record) error {
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			log.Errorf("cannot migrate payment %s: %s", r.Account, err)
+			return nil
+		}
+		if p.SchemaVersion > paymentSchemaVersion {
+			return fmt.Errorf("payment %s has schema version %d which is newer than supported version %d, upgrade accept-nano", r.Account, p.SchemaVersion, paymentSchemaVersion)
+		}
+		if p.SchemaVersion < paymentSchemaVersion {
+			accounts = append(accounts, r.Account)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		err = migratePayment(account)
+		if err != nil {
+			return fmt.Errorf("cannot migrate payment %s: %w", account, err)
+		}
+	}
+	for _, m := range pending {
+		err = s.SetMigrated(m.version, m.name)
+		if err != nil {
+			return err
+		}
+		log.Noticef("applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+// migratePayment applies the migrations newer than the schema version of the payment and saves it.
+// If the payment is saved by another instance meanwhile, it is loaded and migrated again.
+// This way instances that start at the same time in high availability mode can run migrations concurrently.
+func migratePayment(account string) error {
+	for {
+		err := migratePaymentOnce(account)
+		if err != store.ErrConflict {
+			return err
+		}
+		log.Debugf("payment %s is saved by another instance, migrating again", account)
+	}
+}
+
+func migratePaymentOnce(account string) error {
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	p, err := LoadPayment(account)
+	if err == errPaymentNotFound {
+		// Archived by another instance.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.SchemaVersion >= paymentSchemaVersion {
+		// Migrated by another instance.
+		return nil
+	}
+	for _, m := range migrations {
+		if m.version <= p.SchemaVersion {
+			continue
+		}
+		err = m.migrate(p)
+		if err != nil {
+			return err
+		}
+		p.SchemaVersion = m.version
+	}
+	return p.Save()
+}
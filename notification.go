@@ -1,18 +1,217 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/internal/units"
 	"github.com/shopspring/decimal"
 )
 
+var errWebhookSecretNotFound = errors.New("webhook secret of the delivery is not found in config")
+
+// EventType is the type of payment lifecycle event sent to the webhook endpoints.
+type EventType string
+
+const (
+	EventCreated       EventType = "created"
+	EventPartiallyPaid EventType = "partially_paid"
+	EventFulfilled     EventType = "fulfilled"
+	EventReceived      EventType = "received"
+	EventSent          EventType = "sent"
+	EventExpired       EventType = "expired"
+	EventLatePaid      EventType = "late_paid"
+	EventRefunded      EventType = "refunded"
+	EventCancelled     EventType = "cancelled"
+)
+
+var eventTypes = []EventType{
+	EventCreated,
+	EventPartiallyPaid,
+	EventFulfilled,
+	EventReceived,
+	EventSent,
+	EventExpired,
+	EventLatePaid,
+	EventRefunded,
+	EventCancelled,
+}
+
+// WebhookEndpoint is a merchant URL that receives notifications for subscribed events.
+type WebhookEndpoint struct {
+	// Notifications are posted to this URL.
+	URL string
+	// Secret key for signing notifications sent to URL.
+	Secret string
+	// Names of the events sent to URL. All events are sent if empty.
+	Events []string
+}
+
+func (e *WebhookEndpoint) subscribed(event EventType) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, name := range e.Events {
+		if EventType(name) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookEndpoints returns Webhooks in config together with the legacy NotificationURL.
+// NotificationURL only receives fulfilled events.
+func webhookEndpoints() []WebhookEndpoint {
+	endpoints := make([]WebhookEndpoint, 0, len(config.Webhooks)+1)
+	if config.NotificationURL != "" {
+		endpoints = append(endpoints, WebhookEndpoint{
+			URL:    config.NotificationURL,
+			Secret: config.NotificationSecret,
+			Events: []string{string(EventFulfilled)},
+		})
+	}
+	return append(endpoints, config.Webhooks...)
+}
+
+// secretID returns an identifier of the secret of the endpoint to be saved with deliveries.
+// Empty if the endpoint has no secret.
+func (e *WebhookEndpoint) secretID() string {
+	if e.Secret == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(e.Secret))
+	return hex.EncodeToString(h[:8])
+}
+
+// webhookSecret returns the secret for signing the delivery.
+// Secret of the endpoint that the delivery is queued for is found by its ID, so it does not change if URLs of the endpoints are changed.
+// Deliveries queued for endpoints without a secret, or by older versions, are signed with the secret of the first endpoint with their URL.
+func webhookSecret(d *Delivery) (string, error) {
+	for _, e := range webhookEndpoints() {
+		if d.SecretID == "" && e.URL == d.URL {
+			return e.Secret, nil
+		}
+		if d.SecretID != "" && e.secretID() == d.SecretID {
+			return e.Secret, nil
+		}
+	}
+	if d.SecretID != "" {
+		return "", errWebhookSecretNotFound
+	}
+	return "", nil
+}
+
+func validateWebhookEndpoints() error {
+	for _, e := range config.Webhooks {
+		if e.URL == "" {
+			return errors.New("empty webhook URL")
+		}
+	outer:
+		for _, name := range e.Events {
+			for _, t := range eventTypes {
+				if EventType(name) == t {
+					continue outer
+				}
+			}
+			return fmt.Errorf("invalid event %q for webhook %s", name, e.URL)
+		}
+	}
+	return nil
+}
+
+// Notification is the payload posted to webhook endpoints.
 type Notification struct {
-	Account          string          `json:"account"`
-	Amount           decimal.Decimal `json:"amount"`
-	AmountInCurrency decimal.Decimal `json:"amountInCurrency"`
-	Currency         string          `json:"currency"`
-	Balance          decimal.Decimal `json:"balance"`
-	State            string          `json:"state"`
-	Fulfilled        bool            `json:"fulfilled"`
-	FulfilledAt      *time.Time      `json:"fulfillAt"`
+	Event            EventType                     `json:"event"`
+	Account          string                        `json:"account"`
+	Amount           decimal.Decimal               `json:"amount"`
+	AmountInCurrency decimal.Decimal               `json:"amountInCurrency"`
+	Currency         string                        `json:"currency"`
+	Balance          decimal.Decimal               `json:"balance"`
+	Overpaid         decimal.Decimal               `json:"overpaid"`
+	SubPayments      map[string]SubPaymentResponse `json:"subPayments"`
+	Refunds          []RefundResponse              `json:"refunds"`
+	State            string                        `json:"state"`
+	OrderID          string                        `json:"orderId,omitempty"`
+	Description      string                        `json:"description,omitempty"`
+	Metadata         map[string]interface{}        `json:"metadata,omitempty"`
+	Status           Status                        `json:"status"`
+	Fulfilled        bool                          `json:"fulfilled"`
+	CreatedAt        time.Time                     `json:"createdAt"`
+	FulfilledAt      *time.Time                    `json:"fulfillAt"`
+	NotifiedAt       *time.Time                    `json:"notifiedAt"`
+	ReceivedAt       *time.Time                    `json:"receivedAt"`
+	SentAt           *time.Time                    `json:"sentAt"`
+	ExpiredAt        *time.Time                    `json:"expiredAt"`
+	CancelledAt      *time.Time                    `json:"cancelledAt"`
+	LatePaidAt       *time.Time                    `json:"latePaidAt"`
+}
+
+func NewNotification(p *Payment, event EventType) *Notification {
+	subPayments := make(map[string]SubPaymentResponse, len(p.SubPayments))
+	for k, v := range p.SubPayments {
+		subPayments[k] = SubPaymentResponse{Account: v.Account, Amount: units.RawToNano(v.Amount)}
+	}
+	refunds := make([]RefundResponse, 0, len(p.Refunds))
+	for _, r := range p.Refunds {
+		refunds = append(refunds, RefundResponse{Hash: r.Hash, Account: r.Account, Amount: units.RawToNano(r.Amount)})
+	}
+	return &Notification{
+		Event:            event,
+		Account:          p.account,
+		Amount:           units.RawToNano(p.Amount),
+		AmountInCurrency: p.AmountInCurrency,
+		Currency:         p.Currency,
+		Balance:          units.RawToNano(p.Balance),
+		Overpaid:         units.RawToNano(p.Overpaid),
+		SubPayments:      subPayments,
+		Refunds:          refunds,
+		State:            p.State,
+		OrderID:          p.OrderID,
+		Description:      p.Description,
+		Metadata:         p.Metadata,
+		Status:           p.Status,
+		Fulfilled:        p.FulfilledAt != nil,
+		CreatedAt:        p.CreatedAt,
+		FulfilledAt:      p.FulfilledAt,
+		NotifiedAt:       p.NotifiedAt,
+		ReceivedAt:       p.ReceivedAt,
+		SentAt:           p.SentAt,
+		ExpiredAt:        p.ExpiredAt,
+		CancelledAt:      p.CancelledAt,
+		LatePaidAt:       p.LatePaidAt,
+	}
+}
+
+// publishEvent prepares a notification for every webhook endpoint subscribed to the event.
+// Notifications are queued when the payment is saved so that they are not sent for changes that are not saved.
+func (p *Payment) publishEvent(event EventType) error {
+	ds, err := p.eventDeliveries(event)
+	if err != nil {
+		return err
+	}
+	p.deliveries = append(p.deliveries, ds...)
+	return nil
+}
+
+// eventDeliveries returns the deliveries of the event to be queued in the store.
+func (p *Payment) eventDeliveries(event EventType) ([]*store.Delivery, error) {
+	var endpoints []WebhookEndpoint
+	for _, e := range webhookEndpoints() {
+		if e.subscribed(event) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(NewNotification(p, event))
+	if err != nil {
+		return nil, err
+	}
+	return newDeliveries(endpoints, event, data)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/backoff"
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/webhook"
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+var errDeliveryNotFound = errors.New("delivery not found")
+
+// Wakes up the delivery worker when a new delivery is queued.
+var deliveryWakeC = make(chan struct{}, 1)
+
+// Buckets in the local database that deliveries were kept in before they are saved in the payment store.
+// Bolt store uses the same buckets so they are only moved with other backends.
+const (
+	localDeliveriesBucket     = "deliveries"
+	localDeadDeliveriesBucket = "deadDeliveries"
+)
+
+// Delivery is a notification waiting to be sent to the merchant.
+// Deliveries are stored in the payment store in JSON format until they succeed.
+// Failed deliveries are retried with exponential backoff and moved to dead letter queue
+// after NotificationMaxAttempts is reached.
+type Delivery struct {
+	ID string `json:"id"`
+	// Type of the payment event.
+	Event EventType `json:"event"`
+	// Notification is posted to this URL.
+	URL string `json:"url"`
+	// ID of the secret of the webhook endpoint that the delivery is queued for. Empty if the endpoint has no secret.
+	// Delivery is not sent until the secret is found in config.
+	SecretID string `json:"secretId,omitempty"`
+	// Request body.
+	Body json.RawMessage `json:"body"`
+	// Number of failed attempts.
+	Attempts int `json:"attempts"`
+	// Set when delivery is queued.
+	CreatedAt time.Time `json:"createdAt"`
+	// Delivery is not tried before this time.
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	// Set after every failed attempt.
+	LastAttemptAt *time.Time `json:"lastAttemptAt"`
+	// Error message of the last failed attempt.
+	LastError string `json:"lastError"`
+
+	// ID of the delivery in the store.
+	id uint64
+}
+
+// newDeliveries returns a new delivery for each endpoint to be queued in the store.
+func newDeliveries(endpoints []WebhookEndpoint, event EventType, body []byte) ([]*store.Delivery, error) {
+	ret := make([]*store.Delivery, 0, len(endpoints))
+	for _, e := range endpoints {
+		d := Delivery{
+			Event:         event,
+			URL:           e.URL,
+			SecretID:      e.secretID(),
+			Body:          body,
+			CreatedAt:     time.Now().UTC(),
+			NextAttemptAt: time.Now().UTC(),
+		}
+		data, err := json.Marshal(&d)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, &store.Delivery{Data: data})
+	}
+	return ret, nil
+}
+
+func wakeDeliveryWorker() {
+	select {
+	case deliveryWakeC <- struct{}{}:
+	default:
+	}
+}
+
+// Zero padded for compatibility with the IDs of older versions.
+func formatDeliveryID(id uint64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+func decodeDelivery(sd *store.Delivery) (*Delivery, error) {
+	d := &Delivery{}
+	err := json.Unmarshal(sd.Data, d)
+	if err != nil {
+		return nil, err
+	}
+	d.ID = formatDeliveryID(sd.ID)
+	d.id = sd.ID
+	return d, nil
+}
+
+// save updates the delivery in the store. It is moved to the dead letter queue if dead is set.
+func (d *Delivery) save(dead bool) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return paymentStore.UpdateDelivery(&store.Delivery{ID: d.id, Dead: dead, Data: data})
+}
+
+// LoadDeliveries returns all deliveries in the queue, or in the dead letter queue if dead is set.
+func LoadDeliveries(dead bool) ([]*Delivery, error) {
+	ret := make([]*Delivery, 0)
+	err := paymentStore.ListDeliveries(dead, func(sd *store.Delivery) (bool, error) {
+		d, err := decodeDelivery(sd)
+		if err != nil {
+			log.Error(err)
+			return true, nil
+		}
+		ret = append(ret, d)
+		return true, nil
+	})
+	return ret, err
+}
+
+// ReplayDeadDelivery moves a dead delivery back to the queue and resets its attempts.
+func ReplayDeadDelivery(id string) (*Delivery, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errDeliveryNotFound
+	}
+	sd, err := paymentStore.GetDelivery(n)
+	if err == store.ErrNotFound || (err == nil && !sd.Dead) {
+		return nil, errDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d, err := decodeDelivery(sd)
+	if err != nil {
+		return nil, err
+	}
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now().UTC()
+	err = d.save(false)
+	if err == store.ErrNotFound {
+		return nil, errDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	wakeDeliveryWorker()
+	return d, nil
+}
+
+// moveLocalDeliveries moves the deliveries that are saved in the local database by older versions to the payment store.
+func moveLocalDeliveries() error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range []string{localDeliveriesBucket, localDeadDeliveriesBucket} {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				continue
+			}
+			var ds []*store.Delivery
+			err := b.ForEach(func(k, v []byte) error {
+				ds = append(ds, &store.Delivery{Dead: bucket == localDeadDeliveriesBucket, Data: append([]byte(nil), v...)})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(ds) > 0 {
+				err = paymentStore.AddDeliveries(ds)
+				if err != nil {
+					return err
+				}
+				log.Noticef("moved %d deliveries from %s bucket to the payment store", len(ds), bucket)
+			}
+			err = tx.DeleteBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runDeliveryWorker sends queued deliveries until stop is closed.
+// It runs on a single instance because the queue is shared by all instances in high availability mode.
+func runDeliveryWorker(stop chan struct{}) {
+	defer workersWG.Done()
+	for {
+		wait := processDeliveries(stop)
+		if config.HighAvailability && wait > config.LeaderScanInterval {
+			// Deliveries queued on other instances do not wake up the worker.
+			wait = config.LeaderScanInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-deliveryWakeC:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// processDeliveries tries due deliveries and returns the duration until the next due delivery.
+func processDeliveries(stop chan struct{}) time.Duration {
+	nextWait := config.NotificationRetryMaxInterval
+	deliveries, err := LoadDeliveries(false)
+	if err != nil {
+		log.Errorln("cannot load deliveries:", err)
+		return nextWait
+	}
+	for _, d := range deliveries {
+		select {
+		case <-stop:
+			return nextWait
+		default:
+		}
+		if wait := time.Until(d.NextAttemptAt); wait > 0 {
+			if wait < nextWait {
+				nextWait = wait
+			}
+			continue
+		}
+		err = d.send()
+		if err == nil {
+			log.Debugln("delivered notification:", d.ID)
+			err = d.remove()
+		} else {
+			log.Warningf("cannot deliver notification %s to %s: %s", d.ID, d.URL, err)
+			err = d.retryLater(err)
+			if wait := time.Until(d.NextAttemptAt); wait > 0 && wait < nextWait {
+				nextWait = wait
+			}
+		}
+		if err != nil {
+			log.Errorf("cannot update delivery %s: %s", d.ID, err)
+		}
+	}
+	return nextWait
+}
+
+func (d *Delivery) send() error {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body)) // nolint:noctx // client timeout set
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	secret, err := webhookSecret(d)
+	if err != nil {
+		return err
+	}
+	if secret != "" {
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign([]byte(secret), time.Now(), d.Body))
+	}
+	resp, err := notificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err2 := resp.Body.Close(); err2 != nil {
+			log.Debug(err2)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad notification response: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *Delivery) remove() error {
+	return paymentStore.DeleteDelivery(d.id)
+}
+
+// retryLater schedules the next attempt or moves the delivery to dead letter queue if no attempts left.
+func (d *Delivery) retryLater(sendErr error) error {
+	d.Attempts++
+	d.LastAttemptAt = now()
+	d.LastError = sendErr.Error()
+	d.NextAttemptAt = d.LastAttemptAt.Add(backoff.Exponential(d.Attempts, config.NotificationRetryMinInterval, config.NotificationRetryMaxInterval))
+	dead := d.Attempts >= config.NotificationMaxAttempts
+	if dead {
+		log.Errorf("giving up delivery %s after %d attempts", d.ID, d.Attempts)
+	}
+	return d.save(dead)
+}
@@ -1,19 +1,20 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/accept-nano/accept-nano/internal/maplock"
 	"github.com/accept-nano/accept-nano/internal/nano"
+	"github.com/accept-nano/accept-nano/internal/store"
 	"github.com/accept-nano/accept-nano/internal/units"
 	"github.com/cenkalti/log"
 	"github.com/shopspring/decimal"
-	"go.etcd.io/bbolt"
 )
 
 var (
@@ -27,6 +28,14 @@ var notificationClient http.Client
 type Payment struct {
 	// Customer sends money to this account.
 	account string
+	// Notifications of the events published since the payment is saved.
+	// They are queued in the same transaction when the payment is saved.
+	deliveries []*store.Delivery
+	// Version of the schema the payment is saved with. Zero for payments saved before versioning.
+	// Old payments are updated by migrations on startup.
+	SchemaVersion int `json:"schemaVersion"`
+	// Incremented on every save. Saving fails if the payment is saved by another instance after it is loaded.
+	Version uint64 `json:"version"`
 	// Index for generating deterministic key.
 	Index string `json:"index"`
 	// Currency of amount in original request.
@@ -41,20 +50,55 @@ type Payment struct {
 	Balance decimal.Decimal `json:"balance"`
 	// Individual transactions to pay the total amount.
 	SubPayments map[string]SubPayment `json:"subPayments"`
+	// Current status of the payment.
+	Status Status `json:"status"`
 	// Free text field to pass from customer to merchant.
 	State string `json:"state"`
+	// Optional order ID given by the merchant.
+	OrderID string `json:"orderId,omitempty"`
+	// Optional description of the payment given by the merchant.
+	Description string `json:"description,omitempty"`
+	// Optional structured data given by the merchant.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Max allowed time for payment after it is created.
+	// Zero value means AllowedDuration in config is used.
+	AllowedDuration time.Duration `json:"allowedDuration,omitempty"`
 	// Set when customer created the payment request via API.
 	CreatedAt time.Time `json:"createdAt"`
 	// Set every time Account is checked for incoming funds.
 	LastCheckedAt *time.Time `json:"lastCheckedAt"`
 	// Set when detected customer has sent enough funds to Account.
 	FulfilledAt *time.Time `json:"fulfilledAt"`
-	// Set when merchant is notified.
+	// Set when merchant notification is queued for delivery.
 	NotifiedAt *time.Time `json:"notifiedAt"`
 	// Set when pending funds are accepted to Account.
 	ReceivedAt *time.Time `json:"receivedAt"`
 	// Set when Amount is sent to the merchant account.
+	// In settlement mode, it is set when the funds are collected in the settlement account.
 	SentAt *time.Time `json:"sentAt"`
+	// ID of the settlement that the funds are sent to the merchant account with.
+	// Only set in settlement mode.
+	SettlementID uint64 `json:"settlementId,omitempty"`
+	// Name of the split rule given when the payment is created.
+	SplitRule string `json:"splitRule,omitempty"`
+	// Shares of the split rule at the time the payment is created.
+	// If set, funds are sent to these accounts instead of the merchant account.
+	Split []SplitShare `json:"split,omitempty"`
+	// Send blocks to the accounts in Split.
+	Payouts []Payout `json:"payouts,omitempty"`
+	// Set when allowed duration is passed before the payment is fulfilled.
+	ExpiredAt *time.Time `json:"expiredAt"`
+	// Set when the payment is cancelled by the customer or merchant.
+	CancelledAt *time.Time `json:"cancelledAt"`
+	// Set when funds are detected in Account after the payment is expired or cancelled.
+	LatePaidAt *time.Time `json:"latePaidAt"`
+	// Amount in raw sent over the requested Amount.
+	// Overpaid amount is sent to the merchant together with the requested amount and can be refunded by the merchant.
+	Overpaid decimal.Decimal `json:"overpaid"`
+	// Funds returned to the customers.
+	Refunds []Refund `json:"refunds"`
+	// Funds sent to the merchant account by sweeps after the payment is finished.
+	Sweeps []Sweep `json:"sweeps,omitempty"`
 }
 
 type SubPayment struct {
@@ -66,98 +110,185 @@ type SubPayment struct {
 
 // LoadPayment fetches a Payment object from database by key.
 func LoadPayment(account string) (*Payment, error) {
-	var value []byte
-	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		v := b.Get([]byte(account))
-		if v == nil {
-			return nil
-		}
-		value = make([]byte, len(v))
-		copy(value, v)
-		return nil
-	})
+	r, err := paymentStore.Get(account)
+	if err == store.ErrNotFound {
+		return nil, errPaymentNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	if value == nil {
-		return nil, errPaymentNotFound
+	return decodePayment(account, r.Data)
+}
+
+func decodePayment(account string, value []byte) (*Payment, error) {
+	p := &Payment{account: account}
+	err := json.Unmarshal(value, p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status == "" {
+		p.Status = p.deriveStatus()
+	}
+	return p, nil
+}
+
+// Long State values are not indexed to keep index keys small.
+const maxIndexedStateLength = 512
+
+// setIndexFields sets the indexed fields and the version of the record from the payment.
+func (p *Payment) setIndexFields(r *store.Record) {
+	r.OrderID = p.OrderID
+	if len(p.State) <= maxIndexedStateLength {
+		r.State = p.State
 	}
-	payment := &Payment{account: account}
-	err = json.Unmarshal(value, payment)
-	return payment, err
+	r.CreatedAt = p.CreatedAt
+	r.Version = p.Version
+}
+
+// record returns the payment as a store record.
+// Payments are always saved with the current schema version.
+func (p *Payment) record() (*store.Record, error) {
+	p.SchemaVersion = paymentSchemaVersion
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	r := &store.Record{Account: p.account, Data: data}
+	p.setIndexFields(r)
+	return r, nil
+}
+
+// decodeRecord sets the indexed fields and the version of a record saved in bbolt store.
+func decodeRecord(r *store.Record) error {
+	p, err := decodePayment(r.Account, r.Data)
+	if err != nil {
+		return err
+	}
+	p.setIndexFields(r)
+	return nil
+}
+
+// LoadPaymentsByOrderID returns the payments created with the given order ID.
+func LoadPaymentsByOrderID(orderID string) ([]*Payment, error) {
+	return decodeRecords(paymentStore.FindByOrderID(orderID))
+}
+
+// LoadPaymentsByState returns the payments created with the given State.
+func LoadPaymentsByState(state string) ([]*Payment, error) {
+	return decodeRecords(paymentStore.FindByState(state))
+}
+
+func decodeRecords(records []*store.Record, err error) ([]*Payment, error) {
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Payment, 0, len(records))
+	for _, r := range records {
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
 }
 
 func LoadActivePayments() ([]*Payment, error) {
+	return loadPayments(func(p *Payment) bool { return !p.finished() })
+}
+
+// loadPayments returns the payments in database that match the filter.
+func loadPayments(filter func(*Payment) bool) ([]*Payment, error) {
 	ret := make([]*Payment, 0)
-	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		return b.ForEach(func(k, v []byte) error {
-			p := &Payment{account: string(k)}
-			err := json.Unmarshal(v, p)
-			if err != nil {
-				log.Error(err)
-				return nil
-			}
-			if !p.finished() {
-				ret = append(ret, p)
-			}
+	err := paymentStore.ForEach(func(r *store.Record) error {
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			log.Error(err)
 			return nil
-		})
+		}
+		if filter(p) {
+			ret = append(ret, p)
+		}
+		return nil
 	})
 	return ret, err
 }
 
-// Save the Payment object in database.
+// Save the Payment object in database together with the notifications of the published events.
+// Returns store.ErrConflict if the payment is saved by another instance after it is loaded.
 func (p *Payment) Save() error {
-	value, err := json.Marshal(&p)
+	p.Version++
+	r, err := p.record()
 	if err != nil {
+		p.Version--
 		return err
 	}
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		return b.Put([]byte(p.account), value)
-	})
+	r.Deliveries = p.deliveries
+	err = paymentStore.Put(r)
+	if err != nil {
+		p.Version--
+		return err
+	}
+	if len(p.deliveries) > 0 {
+		p.deliveries = nil
+		wakeDeliveryWorker()
+	}
+	return nil
 }
 
 // SaveNew saves newly created payment. Sets account and index fields before saving.
+// Created event is queued in the same transaction.
 func (p *Payment) SaveNew() error {
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(paymentsBucket))
-		// Before using incremental ids, payment accounts were being generated with random indices.
-		// It is very unlikely that there are many payments with consecutive indices saved in database.
-		var index string
-		var account string
-		found := false
-		for i := 0; i < 100; i++ {
-			// This returns an error only if the Tx is closed or not writeable.
-			// That can't happen in an Update() call so I ignore the error check.
-			id, _ := b.NextSequence()
-			index = strconv.FormatUint(id, 10)
-			key, err := node.DeterministicKey(config.Seed, index)
-			if err != nil {
-				return err
-			}
-			v := b.Get([]byte(key.Account))
-			if v != nil {
-				// Payment exists with generated incremental index. Try next index.
-				continue
-			}
-			found = true
-			account = key.Account
-			break
+	return p.saveNew(nil)
+}
+
+// SaveNewWithIdempotencyKey saves newly created payment together with the idempotency key.
+// Returns store.ErrKeyExists if the key is used by another payment.
+func (p *Payment) SaveNewWithIdempotencyKey(k *store.IdempotencyKey) error {
+	return p.saveNew(k)
+}
+
+func (p *Payment) saveNew(k *store.IdempotencyKey) error {
+	// Before using incremental ids, payment accounts were being generated with random indices.
+	// It is very unlikely that there are many payments with consecutive indices saved in database.
+	for i := 0; i < 100; i++ {
+		id, err := paymentStore.NextSequence()
+		if err != nil {
+			return err
 		}
-		if !found {
-			return errors.New("internal error: cannot create unique index")
+		p.Index = strconv.FormatUint(id, 10)
+		key, err := node.DeterministicKey(config.Seed, p.Index)
+		if err != nil {
+			return err
 		}
-		p.Index = index
-		p.account = account
-		value, err := json.Marshal(&p)
+		p.account = key.Account
+		p.Version = 1
+		r, err := p.record()
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(p.account), value)
-	})
+		if k != nil {
+			k.Account = p.account
+			r.IdempotencyKey = k
+		}
+		r.Deliveries, err = p.eventDeliveries(EventCreated)
+		if err != nil {
+			return err
+		}
+		err = paymentStore.Create(r)
+		if err == store.ErrExists {
+			// Payment exists with generated incremental index. Try next index.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(r.Deliveries) > 0 {
+			wakeDeliveryWorker()
+		}
+		return nil
+	}
+	return errors.New("internal error: cannot create unique index")
 }
 
 // NextCheck returns the next timestamp payment should be checked at.
@@ -182,26 +313,72 @@ func (p Payment) NextCheck() time.Duration {
 	return nextCheck.Sub(now)
 }
 
-// finished returns true after all operations are complete or allowed duration for payment is passed.
+// finished returns true if payment is in a final status or allowed duration for payment is passed.
 func (p Payment) finished() bool {
-	return p.SentAt != nil || now().Sub(p.CreatedAt) > config.AllowedDuration
+	return p.Status.final() || p.SentAt != nil || p.timedOut()
+}
+
+// timedOut returns true if allowed duration for payment is passed.
+func (p Payment) timedOut() bool {
+	return now().Sub(p.CreatedAt) > p.allowedDuration()
 }
 
 func (p Payment) remainingDuration() time.Duration {
-	return p.CreatedAt.Add(config.AllowedDuration).Sub(*now())
+	return p.CreatedAt.Add(p.allowedDuration()).Sub(*now())
 }
 
+func (p Payment) allowedDuration() time.Duration {
+	if p.AllowedDuration != 0 {
+		return p.AllowedDuration
+	}
+	return config.AllowedDuration
+}
+
+// Stop channels of running check loops, keyed by account.
+var (
+	checkers  = make(map[string]chan struct{})
+	checkersM sync.Mutex
+)
+
 // StartChecking starts a goroutine to check the payment periodically.
 func (p *Payment) StartChecking() {
 	if p.finished() {
 		return
 	}
+	checkersM.Lock()
+	defer checkersM.Unlock()
+	if !leading {
+		// Payment is going to be checked by the leader instance.
+		return
+	}
+	if _, ok := checkers[p.account]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	checkers[p.account] = stop
 	checkPaymentWG.Add(1)
-	go p.checkLoop()
+	go p.checkLoop(stop)
 }
 
-func (p *Payment) checkLoop() {
+// stopChecking stops the check loop of the payment if it is running.
+func stopChecking(account string) {
+	checkersM.Lock()
+	defer checkersM.Unlock()
+	if stop, ok := checkers[account]; ok {
+		close(stop)
+		delete(checkers, account)
+	}
+}
+
+func (p *Payment) checkLoop(stop chan struct{}) {
 	defer checkPaymentWG.Done()
+	defer func() {
+		checkersM.Lock()
+		if checkers[p.account] == stop {
+			delete(checkers, p.account)
+		}
+		checkersM.Unlock()
+	}()
 
 	if subs != nil {
 		subs.Subscribe(p.account)
@@ -210,11 +387,16 @@ func (p *Payment) checkLoop() {
 
 	for {
 		if p.finished() {
+			if p.timedOut() && p.Status.canTransition(StatusExpired) {
+				p.expire()
+			}
 			return
 		}
 		select {
 		case <-time.After(p.NextCheck()):
 			p.checkOnce()
+		case <-stop:
+			return
 		case <-stopCheckPayments:
 			return
 		}
@@ -230,13 +412,46 @@ func (p *Payment) checkOnce() {
 		log.Errorln("cannot load payment:", p.account)
 		return
 	}
-	err = p.check()
+	err = p.check(shutdownCtx)
 	if err != nil {
 		log.Errorf("error checking %s: %s", p.account, err)
 		return
 	}
 }
 
+// expire marks the payment as expired and notifies the merchant.
+func (p *Payment) expire() {
+	locks.Lock(p.account)
+	defer locks.Unlock(p.account)
+
+	err := p.reload()
+	if err != nil {
+		log.Errorln("cannot load payment:", p.account)
+		return
+	}
+	if !p.Status.canTransition(StatusExpired) {
+		return
+	}
+	log.Debugln("payment expired:", p.account)
+	err = p.setStatus(StatusExpired)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	p.ExpiredAt = now()
+	err = p.publishEvent(EventExpired)
+	if err != nil {
+		log.Errorf("cannot publish expired event for %s: %s", p.account, err)
+		return
+	}
+	err = p.Save()
+	if err != nil {
+		log.Errorln("cannot save payment:", err)
+		return
+	}
+	go verifications.Publish(PaymentVerified{Payment: *p})
+}
+
 // Reload payment because it might be updated by admin operations.
 func (p *Payment) reload() error {
 	p2, err := LoadPayment(p.account)
@@ -247,9 +462,9 @@ func (p *Payment) reload() error {
 	return nil
 }
 
-func (p *Payment) check() error {
+func (p *Payment) check(ctx context.Context) error {
 	log.Debugln("checking payment:", p.account)
-	err := p.process()
+	err := p.process(ctx)
 	p.LastCheckedAt = now()
 	switch err {
 	case errPaymentNotFulfilled:
@@ -267,12 +482,20 @@ func (p *Payment) check() error {
 
 var locks = maplock.New()
 
-func (p *Payment) process() error { // nolint: gocognit
+func (p *Payment) process(ctx context.Context) error { // nolint: gocognit
+	if p.Status == StatusCancelled {
+		// Funds sent after cancellation are handled by late payment checker.
+		return nil
+	}
 	if p.SentAt == nil { // nolint: nestif
 		if p.ReceivedAt == nil {
 			if p.NotifiedAt == nil {
 				if p.FulfilledAt == nil {
-					err := p.checkPending()
+					err := p.checkPending(ctx)
+					if err != nil {
+						return err
+					}
+					err = p.setStatus(StatusFulfilled)
 					if err != nil {
 						return err
 					}
@@ -287,6 +510,10 @@ func (p *Payment) process() error { // nolint: gocognit
 				if err != nil {
 					return err
 				}
+				err = p.setStatus(StatusNotified)
+				if err != nil {
+					return err
+				}
 				p.NotifiedAt = now()
 				err = p.Save()
 				if err != nil {
@@ -294,21 +521,37 @@ func (p *Payment) process() error { // nolint: gocognit
 				}
 				go verifications.Publish(PaymentVerified{Payment: *p})
 			}
-			err := p.receivePending()
+			err := p.receivePending(ctx)
+			if err != nil {
+				return err
+			}
+			err = p.setStatus(StatusReceived)
 			if err != nil {
 				return err
 			}
 			p.ReceivedAt = now()
+			err = p.publishEvent(EventReceived)
+			if err != nil {
+				return err
+			}
 			err = p.Save()
 			if err != nil {
 				return err
 			}
 		}
-		err := p.sendToMerchant()
+		err := p.sendToMerchant(ctx)
+		if err != nil {
+			return err
+		}
+		err = p.setStatus(StatusSettled)
 		if err != nil {
 			return err
 		}
 		p.SentAt = now()
+		err = p.publishEvent(EventSent)
+		if err != nil {
+			return err
+		}
 		err = p.Save()
 		if err != nil {
 			return err
@@ -322,22 +565,56 @@ func now() *time.Time {
 	return &t
 }
 
-func (p *Payment) checkPending() error {
-	var totalAmount decimal.Decimal
-	accountInfo, err := node.AccountInfo(p.account)
+func (p *Payment) checkPending(ctx context.Context) error {
+	totalAmount, pendingCount, err := p.fetchFunds(ctx)
+	if err != nil {
+		return err
+	}
+	if pendingCount == 0 {
+		return errPaymentNotFulfilled
+	}
+	if !p.Balance.Equal(totalAmount) {
+		p.Balance = totalAmount
+		if !p.isFulfilled() && totalAmount.IsPositive() {
+			err = p.setStatus(StatusPartiallyPaid)
+			if err != nil {
+				return err
+			}
+			err = p.publishEvent(EventPartiallyPaid)
+			if err != nil {
+				return err
+			}
+		}
+		err = p.Save()
+		if err != nil {
+			return err
+		}
+	}
+	if !p.isFulfilled() {
+		return errPaymentNotFulfilled
+	}
+	if p.Balance.GreaterThan(p.Amount) {
+		p.Overpaid = p.Balance.Sub(p.Amount)
+		log.Debugln("overpaid amount:", units.RawToNano(p.Overpaid))
+	}
+	return nil
+}
+
+// fetchFunds returns the total of account balance and pending blocks in the node.
+// Pending blocks are recorded in SubPayments.
+func (p *Payment) fetchFunds(ctx context.Context) (totalAmount decimal.Decimal, pendingCount int, err error) {
+	accountInfo, err := node.AccountInfoContext(ctx, p.account)
+	opened := err == nil
 	switch err {
 	case nano.ErrAccountNotFound:
 	case nil:
 		totalAmount = accountInfo.Balance
 	default:
-		return err
+		return
 	}
-	pendingBlocks, err := node.Pending(p.account, config.MaxPayments, units.NanoToRaw(config.ReceiveThreshold))
+	pendingBlocks, err := node.PendingContext(ctx, p.account, config.MaxPayments, units.NanoToRaw(config.ReceiveThreshold))
 	if err != nil {
-		return err
-	}
-	if len(pendingBlocks) == 0 {
-		return errPaymentNotFulfilled
+		return
 	}
 	for hash, pendingBlock := range pendingBlocks {
 		log.Debugf("received new block: %#v", hash)
@@ -351,18 +628,23 @@ func (p *Payment) checkPending() error {
 			Amount:  pendingBlock.Amount,
 		}
 	}
-	log.Debugln("total amount:", units.RawToNano(totalAmount))
-	if !p.Balance.Equal(totalAmount) {
-		p.Balance = totalAmount
-		err = p.Save()
-		if err != nil {
-			return err
-		}
+	if !opened && len(pendingBlocks) > 0 {
+		p.precomputeOpenWork()
 	}
-	if !p.isFulfilled() {
-		return errPaymentNotFulfilled
+	log.Debugln("total amount:", units.RawToNano(totalAmount))
+	return totalAmount, len(pendingBlocks), nil
+}
+
+// precomputeOpenWork starts generating work for the first block of the payment account in background.
+// It is called when the first pending block is seen so that work is not generated for payments that are never paid.
+func (p *Payment) precomputeOpenWork() {
+	key, err := node.DeterministicKey(config.Seed, p.Index)
+	if err != nil {
+		log.Errorln("cannot generate key for precomputing work:", err)
+		return
 	}
-	return nil
+	// Work for the open block is generated from the public key of the account.
+	precomputeWork(key.Public, false)
 }
 
 func (p *Payment) isFulfilled() bool {
@@ -382,8 +664,8 @@ func (p *Payment) isFulfilled() bool {
 	return p.Balance.GreaterThanOrEqual(p.Amount)
 }
 
-func (p *Payment) receivePending() error {
-	pendingBlocks, err := node.Pending(p.account, config.MaxPayments, units.NanoToRaw(config.ReceiveThreshold))
+func (p *Payment) receivePending(ctx context.Context) error {
+	pendingBlocks, err := node.PendingContext(ctx, p.account, config.MaxPayments, units.NanoToRaw(config.ReceiveThreshold))
 	if err != nil {
 		return err
 	}
@@ -395,7 +677,7 @@ func (p *Payment) receivePending() error {
 		return err
 	}
 	for hash, pendingBlock := range pendingBlocks {
-		err = receiveBlock(hash, pendingBlock.Amount, p.account, key.Private, key.Public)
+		err = receiveBlock(ctx, hash, pendingBlock.Amount, p.account, key.Private, key.Public)
 		if err != nil {
 			return err
 		}
@@ -403,43 +685,23 @@ func (p *Payment) receivePending() error {
 	return nil
 }
 
-func (p *Payment) sendToMerchant() error {
+// sendToMerchant sends all of the balance to the merchant account.
+// If the payment has a split rule, funds are sent to the accounts in the rule instead.
+// Otherwise in settlement mode, funds are collected in the settlement account to be sent with the next settlement.
+func (p *Payment) sendToMerchant(ctx context.Context) error {
 	key, err := node.DeterministicKey(config.Seed, p.Index)
 	if err != nil {
 		return err
 	}
-	return sendAll(p.account, config.Account, key.Private)
+	if len(p.Split) > 0 {
+		return p.sendPayouts(ctx, key.Private)
+	}
+	if config.SettlementInterval > 0 {
+		return p.collect(ctx, key.Private)
+	}
+	return sendAll(ctx, p.account, config.Account, key.Private)
 }
 
 func (p *Payment) notifyMerchant() error {
-	if config.NotificationURL == "" {
-		return nil
-	}
-	notification := Notification{
-		Account:          p.account,
-		Amount:           units.RawToNano(p.Amount),
-		AmountInCurrency: p.AmountInCurrency,
-		Currency:         p.Currency,
-		Balance:          units.RawToNano(p.Balance),
-		State:            p.State,
-		Fulfilled:        p.FulfilledAt != nil,
-		FulfilledAt:      p.FulfilledAt,
-	}
-	data, err := json.Marshal(notification)
-	if err != nil {
-		return err
-	}
-	resp, err := notificationClient.Post(config.NotificationURL, "application/json", bytes.NewReader(data)) // nolint:noctx // client timeout set
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err2 := resp.Body.Close(); err2 != nil {
-			log.Debug(err2)
-		}
-	}()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("bad notification response")
-	}
-	return nil
+	return p.publishEvent(EventFulfilled)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// PaymentQuery contains filters for listing payments.
+// Zero values mean no filtering.
+type PaymentQuery struct {
+	Statuses []Status
+	// Payments created in [CreatedFrom, CreatedTo) are returned.
+	CreatedFrom, CreatedTo time.Time
+	Currency               string
+	// Bounds for Amount in raw.
+	MinAmount, MaxAmount *decimal.Decimal
+	// Payments are sorted by creation time. Newest payments are returned first if set.
+	Descending bool
+	// Max number of payments in a page.
+	Limit int
+	// Listing continues after the payment with this cursor.
+	Cursor string
+}
+
+// PaymentPage is a single page of payments returned for a PaymentQuery.
+type PaymentPage struct {
+	Payments []*Payment `json:"payments"`
+	// Cursor for the next page. Empty if there are no more payments.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+func (q *PaymentQuery) match(p *Payment) bool {
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, s := range q.Statuses {
+			if p.Status == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Currency != "" && p.Currency != q.Currency {
+		return false
+	}
+	if q.MinAmount != nil && p.Amount.LessThan(*q.MinAmount) {
+		return false
+	}
+	if q.MaxAmount != nil && p.Amount.GreaterThan(*q.MaxAmount) {
+		return false
+	}
+	return true
+}
+
+// QueryPayments lists payments matching the query in creation order.
+func QueryPayments(q PaymentQuery) (*PaymentPage, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	} else if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+	opts := q.listOptions()
+	if q.Cursor != "" {
+		var err error
+		opts.After, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	page := &PaymentPage{Payments: make([]*Payment, 0)}
+	var last *Payment
+	err := paymentStore.List(opts, func(r *store.Record) (bool, error) {
+		if len(page.Payments) == limit {
+			page.NextCursor = encodeCursor(last)
+			return false, nil
+		}
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			return false, err
+		}
+		if q.match(p) {
+			page.Payments = append(page.Payments, p)
+			last = p
+		}
+		return true, nil
+	})
+	return page, err
+}
+
+func (q *PaymentQuery) listOptions() store.ListOptions {
+	return store.ListOptions{
+		CreatedFrom: q.CreatedFrom,
+		CreatedTo:   q.CreatedTo,
+		Descending:  q.Descending,
+	}
+}
+
+// encodeCursor returns the cursor for listing payments after p.
+// Cursor contains the creation time in nanoseconds followed by the account.
+func encodeCursor(p *Payment) string {
+	b := make([]byte, 8, 8+len(p.account))
+	binary.BigEndian.PutUint64(b, uint64(p.CreatedAt.UnixNano()))
+	b = append(b, p.account...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*store.Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) <= 8 {
+		return nil, errInvalidCursor
+	}
+	return &store.Cursor{
+		CreatedAt: time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))),
+		Account:   string(b[8:]),
+	}, nil
+}
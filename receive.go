@@ -1,18 +1,36 @@
 package main
 
 import (
+	"context"
+
 	"github.com/accept-nano/accept-nano/internal/nano"
 	"github.com/accept-nano/accept-nano/internal/units"
 	"github.com/cenkalti/log"
 	"github.com/shopspring/decimal"
 )
 
-func receiveBlock(hash string, amount decimal.Decimal, account, privateKey, publicKey string) error {
+// generateWork returns the precomputed work for hash if it is cached.
+// Otherwise work is generated with WorkProvider. It is aborted when ctx is done or after WorkTimeout.
+func generateWork(ctx context.Context, hash string, forSend bool) (string, error) {
+	if config.WorkTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.WorkTimeout)
+		defer cancel()
+	}
+	waitWorkInFlight(ctx, hash)
+	if work, ok := loadCachedWork(hash, forSend, true); ok {
+		log.Debugln("using cached work for", hash)
+		return work, nil
+	}
+	return workProvider.GenerateWork(ctx, hash, forSend)
+}
+
+func receiveBlock(ctx context.Context, hash string, amount decimal.Decimal, account, privateKey, publicKey string) error {
 	log.Debugln("amount:", units.RawToNano(amount).String())
 	var newReceiverBlockPreviousHash string
 	var newReceiverBalance decimal.Decimal
 	var workHash string
-	receiverAccountInfo, err := node.AccountInfo(account)
+	receiverAccountInfo, err := node.AccountInfoContext(ctx, account)
 	switch err {
 	case nano.ErrAccountNotFound:
 		// First block in account chain. This is the common case.
@@ -28,19 +46,21 @@ func receiveBlock(hash string, amount decimal.Decimal, account, privateKey, publ
 	default:
 		return err
 	}
-	work, err := nano.GenerateWork(workHash, false)
+	work, err := generateWork(ctx, workHash, false)
 	if err != nil {
 		return err
 	}
-	newReceiverBlock, err := node.BlockCreate(newReceiverBlockPreviousHash, account, config.Representative, newReceiverBalance, hash, privateKey, work)
+	newReceiverBlock, _, err := node.BlockCreate(newReceiverBlockPreviousHash, account, config.Representative, newReceiverBalance, hash, privateKey, work)
 	if err != nil {
 		return err
 	}
 	log.Debugf("new block: %#v", newReceiverBlock)
-	newHash, err := node.Process(newReceiverBlock)
+	newHash, err := publishBlock(newReceiverBlock)
 	if err != nil {
 		return err
 	}
 	log.Debugln("published new block:", newHash)
+	// Next block of the account is usually a send block.
+	precomputeWork(newHash, true)
 	return nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/nano"
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	errRefundExceedsPayments = errors.New("refund amount exceeds the amount sent by customers")
+	errRefundForwarded       = errors.New("funds of the payment are already sent to the merchant, refund them from the merchant account")
+	errRefundNotAllowed      = errors.New("payment is in progress, only expired, cancelled, late paid or settled payments can be refunded")
+)
+
+// Refund is a send block from the payment account back to a customer account.
+type Refund struct {
+	// Hash of the send block.
+	Hash string `json:"hash"`
+	// Customer account that the funds are returned to.
+	Account string `json:"account"`
+	// Amount in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Set when the block is published.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// refund returns funds in the payment account to the customer accounts recorded in SubPayments.
+// If amount is zero, all of the balance is refunded.
+// Each customer gets back at most the amount they have sent minus previous refunds.
+// Refunds are saved after each published block so that a failure in the middle does not cause double refunds.
+// Funds that are already forwarded to the merchant, including overpaid amounts, cannot be refunded from the payment account.
+// Payments that are still in progress cannot be refunded.
+func (p *Payment) refund(ctx context.Context, amount decimal.Decimal) ([]Refund, error) {
+	if !p.Status.refundable() {
+		return nil, errRefundNotAllowed
+	}
+	err := p.receivePending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := node.AccountInfoContext(ctx, p.account)
+	if err == nano.ErrAccountNotFound {
+		return nil, p.insufficientBalanceError()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if amount.IsZero() {
+		amount = info.Balance
+	}
+	if !amount.IsPositive() || amount.GreaterThan(info.Balance) {
+		return nil, p.insufficientBalanceError()
+	}
+	legs, err := p.refundLegs(amount)
+	if err != nil {
+		return nil, err
+	}
+	key, err := node.DeterministicKey(config.Seed, p.Index)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Refund, 0, len(legs))
+	for _, leg := range legs {
+		log.Noticef("refunding %s from %s to %s", units.RawToNano(leg.Amount), p.account, leg.Account)
+		leg.Hash, err = sendAmount(ctx, p.account, leg.Account, key.Private, leg.Amount)
+		if err != nil {
+			return ret, err
+		}
+		leg.CreatedAt = time.Now().UTC()
+		ret = append(ret, leg)
+		p.Refunds = append(p.Refunds, leg)
+		err = p.Save()
+		if err != nil {
+			return ret, err
+		}
+	}
+	err = p.publishEvent(EventRefunded)
+	if err != nil {
+		return ret, err
+	}
+	return ret, p.Save()
+}
+
+// insufficientBalanceError returns the error for refunds that exceed the balance of the payment account.
+func (p *Payment) insufficientBalanceError() error {
+	if p.SentAt != nil {
+		return errRefundForwarded
+	}
+	return errInsufficientBalance
+}
+
+// refundLegs distributes amount to customer accounts.
+func (p *Payment) refundLegs(amount decimal.Decimal) ([]Refund, error) {
+	refundable := make(map[string]decimal.Decimal)
+	for _, sp := range p.SubPayments {
+		refundable[sp.Account] = refundable[sp.Account].Add(sp.Amount)
+	}
+	for _, r := range p.Refunds {
+		refundable[r.Account] = refundable[r.Account].Sub(r.Amount)
+	}
+	accounts := make([]string, 0, len(refundable))
+	for account := range refundable {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	var legs []Refund
+	remaining := amount
+	for _, account := range accounts {
+		if !remaining.IsPositive() {
+			break
+		}
+		legAmount := decimal.Min(remaining, refundable[account])
+		if !legAmount.IsPositive() {
+			continue
+		}
+		legs = append(legs, Refund{Account: account, Amount: legAmount})
+		remaining = remaining.Sub(legAmount)
+	}
+	if remaining.IsPositive() {
+		return nil, errRefundExceedsPayments
+	}
+	return legs, nil
+}
+
+// RefundPayment locks and refunds the payment with the given account.
+func RefundPayment(ctx context.Context, account string, amount decimal.Decimal) (*Payment, error) {
+	locks.Lock(account)
+	defer locks.Unlock(account)
+	payment, err := LoadPayment(account)
+	if err != nil {
+		return nil, err
+	}
+	_, err = payment.refund(ctx, amount)
+	return payment, err
+}
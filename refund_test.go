@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefundLegs(t *testing.T) {
+	subPayments := map[string]SubPayment{
+		"hash1": {Account: "b", Amount: decimal.NewFromInt(300)},
+		"hash2": {Account: "a", Amount: decimal.NewFromInt(500)},
+		"hash3": {Account: "b", Amount: decimal.NewFromInt(200)},
+	}
+	cases := []struct {
+		name    string
+		refunds []Refund
+		amount  int64
+		legs    []Refund
+		err     error
+	}{
+		{
+			name:   "all",
+			amount: 1000,
+			legs:   []Refund{{Account: "a", Amount: decimal.NewFromInt(500)}, {Account: "b", Amount: decimal.NewFromInt(500)}},
+		},
+		{
+			name:   "partial from first account",
+			amount: 400,
+			legs:   []Refund{{Account: "a", Amount: decimal.NewFromInt(400)}},
+		},
+		{
+			name:   "partial across accounts",
+			amount: 700,
+			legs:   []Refund{{Account: "a", Amount: decimal.NewFromInt(500)}, {Account: "b", Amount: decimal.NewFromInt(200)}},
+		},
+		{
+			name:    "after partial refund",
+			refunds: []Refund{{Account: "a", Amount: decimal.NewFromInt(400)}},
+			amount:  600,
+			legs:    []Refund{{Account: "a", Amount: decimal.NewFromInt(100)}, {Account: "b", Amount: decimal.NewFromInt(500)}},
+		},
+		{
+			name:    "account refunded fully",
+			refunds: []Refund{{Account: "a", Amount: decimal.NewFromInt(500)}},
+			amount:  300,
+			legs:    []Refund{{Account: "b", Amount: decimal.NewFromInt(300)}},
+		},
+		{
+			name:   "more than sent",
+			amount: 1001,
+			err:    errRefundExceedsPayments,
+		},
+		{
+			name:    "more than left after partial refund",
+			refunds: []Refund{{Account: "b", Amount: decimal.NewFromInt(500)}},
+			amount:  501,
+			err:     errRefundExceedsPayments,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := &Payment{SubPayments: subPayments, Refunds: c.refunds}
+			legs, err := p.refundLegs(decimal.NewFromInt(c.amount))
+			assert.Equal(t, c.err, err)
+			if !assert.Len(t, legs, len(c.legs)) {
+				return
+			}
+			for i := range c.legs {
+				assert.Equal(t, c.legs[i].Account, legs[i].Account)
+				assert.True(t, c.legs[i].Amount.Equal(legs[i].Amount), "leg %d: expected %s, got %s", i, c.legs[i].Amount, legs[i].Amount)
+			}
+		})
+	}
+}
+
+func TestRefundableStatus(t *testing.T) {
+	cases := map[Status]bool{
+		StatusPending:       false,
+		StatusPartiallyPaid: false,
+		StatusFulfilled:     false,
+		StatusNotified:      false,
+		StatusReceived:      false,
+		StatusSettled:       true,
+		StatusExpired:       true,
+		StatusCancelled:     true,
+		StatusLatePaid:      true,
+	}
+	for status, refundable := range cases {
+		assert.Equal(t, refundable, status.refundable(), status)
+	}
+}
+
+func TestRefundInProgress(t *testing.T) {
+	p := &Payment{Status: StatusReceived}
+	_, err := p.refund(context.Background(), decimal.Zero)
+	assert.Equal(t, errRefundNotAllowed, err)
+}
@@ -18,6 +18,10 @@ type Response struct {
 	SubPayments      map[string]SubPaymentResponse `json:"subPayments"`
 	RemainingSeconds int                           `json:"remainingSeconds"`
 	State            string                        `json:"state"`
+	OrderID          string                        `json:"orderId,omitempty"`
+	Description      string                        `json:"description,omitempty"`
+	Metadata         map[string]interface{}        `json:"metadata,omitempty"`
+	Status           Status                        `json:"status"`
 	Fulfilled        bool                          `json:"fulfilled"`
 	MerchantNotified bool                          `json:"merchantNotified"`
 }
@@ -27,6 +31,12 @@ type SubPaymentResponse struct {
 	Account string          `json:"account"`
 }
 
+type RefundResponse struct {
+	Hash    string          `json:"hash"`
+	Amount  decimal.Decimal `json:"amount"`
+	Account string          `json:"account"`
+}
+
 func NewResponse(p *Payment, token string) *Response {
 	subPayments := make(map[string]SubPaymentResponse, len(p.SubPayments))
 	for k, v := range p.SubPayments {
@@ -40,6 +50,10 @@ func NewResponse(p *Payment, token string) *Response {
 		Currency:         p.Currency,
 		Balance:          units.RawToNano(p.Balance),
 		State:            p.State,
+		OrderID:          p.OrderID,
+		Description:      p.Description,
+		Metadata:         p.Metadata,
+		Status:           p.Status,
 		SubPayments:      subPayments,
 		RemainingSeconds: int(p.remainingDuration() / time.Second),
 		Fulfilled:        p.FulfilledAt != nil,
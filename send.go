@@ -1,32 +1,72 @@
 package main
 
 import (
+	"context"
+	"errors"
+
 	"github.com/accept-nano/accept-nano/internal/nano"
 	"github.com/cenkalti/log"
 	"github.com/shopspring/decimal"
 )
 
-func sendAll(account, destination, privateKey string) error {
+var errInsufficientBalance = errors.New("insufficient balance")
+
+func sendAll(ctx context.Context, account, destination, privateKey string) error {
 	log.Debugln("sending from", account)
-	info, err := node.AccountInfo(account)
+	info, err := node.AccountInfoContext(ctx, account)
 	if err != nil {
 		return err
 	}
 	if info.Balance.IsZero() {
 		return nil
 	}
-	work, err := nano.GenerateWork(info.Frontier, true)
+	_, err = sendBlock(ctx, info, account, destination, privateKey, decimal.Zero)
+	return err
+}
+
+// sendAmount sends amount in raw from account to destination and returns the hash of the published block.
+func sendAmount(ctx context.Context, account, destination, privateKey string, amount decimal.Decimal) (string, error) {
+	log.Debugln("sending", amount, "from", account, "to", destination)
+	info, err := node.AccountInfoContext(ctx, account)
 	if err != nil {
-		return err
+		return "", err
 	}
-	block, err := node.BlockCreate(info.Frontier, account, config.Representative, decimal.Zero, destination, privateKey, work)
+	if info.Balance.LessThan(amount) {
+		return "", errInsufficientBalance
+	}
+	return sendBlock(ctx, info, account, destination, privateKey, info.Balance.Sub(amount))
+}
+
+func sendBlock(ctx context.Context, info *nano.AccountInfo, account, destination, privateKey string, newBalance decimal.Decimal) (string, error) {
+	block, _, err := createSendBlock(ctx, info, account, destination, privateKey, newBalance)
 	if err != nil {
-		return err
+		return "", err
 	}
-	hash, err := node.Process(block)
+	hash, err := publishBlock(block)
 	if err != nil {
-		return err
+		return "", err
 	}
 	log.Debugln("published new block:", hash)
-	return nil
+	return hash, nil
+}
+
+// createSendBlock generates the work and creates a send block on top of the frontier in info without publishing it.
+// Returns the block and its hash.
+func createSendBlock(ctx context.Context, info *nano.AccountInfo, account, destination, privateKey string, newBalance decimal.Decimal) (block, hash string, err error) {
+	work, err := generateWork(ctx, info.Frontier, true)
+	if err != nil {
+		return "", "", err
+	}
+	return node.BlockCreate(info.Frontier, account, config.Representative, newBalance, destination, privateKey, work)
+}
+
+// publishBlock publishes the block with the node timeout regardless of the context of the caller.
+// A cancelled request may still publish the block and the same funds would be sent again with a new block on the next attempt.
+// In high availability mode, blocks are only published while this instance holds the leader lease.
+func publishBlock(block string) (string, error) {
+	err := checkLeaderLease()
+	if err != nil {
+		return "", err
+	}
+	return node.Process(block)
 }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/nano"
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Index of the settlement account key. Payment indexes start from 1.
+const settlementAccountIndex = "0"
+
+// Failed settlements are retried after this duration.
+const settlementRetryDelay = time.Minute
+
+var errSettlementNotFound = errors.New("settlement not found")
+
+// SettlementStatus is the state of the settlement in its lifecycle.
+type SettlementStatus string
+
+const (
+	// Payments are being collected in the settlement account.
+	SettlementOpen SettlementStatus = "open"
+	// No more payments are added. Funds are being sent to the merchant account.
+	SettlementSending SettlementStatus = "sending"
+	// Funds are sent to the merchant account.
+	SettlementSent SettlementStatus = "sent"
+)
+
+// Settlement is a batch of payments sent from the settlement account to the merchant account in a single block.
+type Settlement struct {
+	ID     uint64           `json:"id"`
+	Status SettlementStatus `json:"status"`
+	// Total amount in raw collected from the payments.
+	Amount decimal.Decimal `json:"amount"`
+	// Payments collected in the settlement account.
+	Payments []SettledPayment `json:"payments"`
+	// Set when the first payment is collected.
+	CreatedAt time.Time `json:"createdAt"`
+	// Set when the settlement is closed for new payments.
+	ClosedAt *time.Time `json:"closedAt"`
+	// Set when Amount is sent to the merchant account.
+	SentAt *time.Time `json:"sentAt"`
+	// Merchant account that Amount is sent to.
+	Account string `json:"account,omitempty"`
+	// Hash of the send block to the merchant account.
+	Hash string `json:"hash,omitempty"`
+	// Error message of the last failed attempt to send.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// SettledPayment is a send block from a payment account to the settlement account.
+type SettledPayment struct {
+	// Payment account.
+	Account string `json:"account"`
+	// Amount in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Hash of the send block.
+	Hash string `json:"hash"`
+	// Set while the send block is being published. Entries are saved before the block is published so that
+	// funds sent to the settlement account are always recorded. Entries of blocks that are not published are removed.
+	Publishing bool `json:"publishing,omitempty"`
+	// Set when the block is received in the settlement account.
+	Received bool `json:"received"`
+}
+
+// settlementMu serializes the changes to the open settlement.
+// It is only held while the settlement is loaded and saved, not while blocks are created or published.
+var settlementMu sync.Mutex
+
+// Wakes up the settlement scheduler when the open settlement reaches SettlementThreshold.
+var settlementWakeC = make(chan struct{}, 1)
+
+// settlementKey returns the key of the account that payments are collected in.
+func settlementKey() (*nano.Key, error) {
+	return node.DeterministicKey(config.Seed, settlementAccountIndex)
+}
+
+// LoadSettlement fetches a Settlement from the store by ID.
+func LoadSettlement(id uint64) (*Settlement, error) {
+	r, err := paymentStore.GetSettlement(id)
+	if err == store.ErrNotFound {
+		return nil, errSettlementNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st Settlement
+	return &st, json.Unmarshal(r.Data, &st)
+}
+
+// LoadSettlements returns at most limit settlements with IDs lower than before, newest first. Zero before means no limit.
+func LoadSettlements(before uint64, limit int) ([]*Settlement, error) {
+	ret := make([]*Settlement, 0)
+	err := paymentStore.ListSettlements(before, func(r *store.Settlement) (bool, error) {
+		var st Settlement
+		if err := json.Unmarshal(r.Data, &st); err != nil {
+			return false, err
+		}
+		ret = append(ret, &st)
+		return len(ret) < limit, nil
+	})
+	return ret, err
+}
+
+// Save the settlement in the store.
+func (st *Settlement) Save() error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return paymentStore.PutSettlement(&store.Settlement{ID: st.ID, Data: data})
+}
+
+// loadOpenSettlement returns the open settlement or nil if there is none.
+// A new settlement is only opened after the previous one is closed, so the open settlement is always the newest.
+func loadOpenSettlement() (*Settlement, error) {
+	settlements, err := LoadSettlements(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(settlements) == 0 || settlements[0].Status != SettlementOpen {
+		return nil, nil
+	}
+	return settlements[0], nil
+}
+
+// collect sends all of the balance in the payment account to the settlement account and adds it to the open settlement.
+// The send block is added to the settlement before it is published and confirmed after.
+// An entry left unconfirmed by a failed attempt is reconciled with the ledger on the next attempt.
+// Caller must hold the lock of the payment account.
+func (p *Payment) collect(ctx context.Context, privateKey string) error {
+	key, err := settlementKey()
+	if err != nil {
+		return err
+	}
+	if p.SettlementID != 0 {
+		err = reconcileSettledPayment(ctx, p.SettlementID, p.account)
+		if err != nil {
+			return err
+		}
+	}
+	info, err := node.AccountInfoContext(ctx, p.account)
+	if err != nil {
+		return err
+	}
+	if info.Balance.IsZero() {
+		return nil
+	}
+	block, hash, err := createSendBlock(ctx, info, p.account, key.Account, privateKey, decimal.Zero)
+	if err != nil {
+		return err
+	}
+	p.SettlementID, err = addToOpenSettlement(SettledPayment{Account: p.account, Amount: info.Balance, Hash: hash, Publishing: true})
+	if err != nil {
+		return err
+	}
+	_, err = publishBlock(block)
+	if err != nil {
+		return err
+	}
+	log.Debugln("published new block:", hash)
+	return confirmSettledPayment(p.SettlementID, hash, true)
+}
+
+// addToOpenSettlement adds sp to the open settlement and returns the ID of the settlement.
+// A new settlement is opened if there is none.
+func addToOpenSettlement(sp SettledPayment) (uint64, error) {
+	settlementMu.Lock()
+	defer settlementMu.Unlock()
+
+	st, err := loadOpenSettlement()
+	if err != nil {
+		return 0, err
+	}
+	if st == nil {
+		id, err2 := paymentStore.NextSettlementID()
+		if err2 != nil {
+			return 0, err2
+		}
+		st = &Settlement{ID: id, Status: SettlementOpen, CreatedAt: time.Now().UTC()}
+	}
+	st.Payments = append(st.Payments, sp)
+	st.Amount = st.Amount.Add(sp.Amount)
+	return st.ID, st.Save()
+}
+
+// confirmSettledPayment marks the entry of the block with hash as published or removes it from the settlement if the block is not published.
+func confirmSettledPayment(id uint64, hash string, published bool) error {
+	settlementMu.Lock()
+	defer settlementMu.Unlock()
+
+	st, err := LoadSettlement(id)
+	if err != nil {
+		return err
+	}
+	i := st.publishingPayment(func(sp *SettledPayment) bool { return sp.Hash == hash })
+	if i == -1 {
+		return nil
+	}
+	if published {
+		st.Payments[i].Publishing = false
+	} else {
+		st.Amount = st.Amount.Sub(st.Payments[i].Amount)
+		st.Payments = append(st.Payments[:i], st.Payments[i+1:]...)
+	}
+	err = st.Save()
+	if err != nil {
+		return err
+	}
+	if published && st.Status == SettlementOpen && config.SettlementThreshold.IsPositive() && st.Amount.GreaterThanOrEqual(units.NanoToRaw(config.SettlementThreshold)) {
+		select {
+		case settlementWakeC <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// reconcileSettledPayment resolves the entry of the payment account that is left in publishing state in the settlement.
+// The entry is confirmed if its block is in the ledger and removed otherwise.
+// Caller must hold the lock of the payment account.
+func reconcileSettledPayment(ctx context.Context, id uint64, account string) error {
+	st, err := LoadSettlement(id)
+	if err != nil {
+		return err
+	}
+	i := st.publishingPayment(func(sp *SettledPayment) bool { return sp.Account == account })
+	if i == -1 {
+		return nil
+	}
+	hash := st.Payments[i].Hash
+	published, err := node.BlockExists(ctx, hash)
+	if err != nil {
+		return err
+	}
+	log.Debugf("reconciled settled payment %s in settlement %d: published=%v", hash, id, published)
+	return confirmSettledPayment(id, hash, published)
+}
+
+// publishingPayment returns the index of the first entry in publishing state that matches f or -1 if there is none.
+func (st *Settlement) publishingPayment(f func(sp *SettledPayment) bool) int {
+	for i := range st.Payments {
+		if st.Payments[i].Publishing && f(&st.Payments[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// runSettlementScheduler sends the collected payments to the merchant account until stop is closed.
+// Open settlement is closed and sent after SettlementInterval passes or when it reaches SettlementThreshold.
+func runSettlementScheduler(stop chan struct{}) {
+	defer workersWG.Done()
+	for {
+		wait, err := settle(stop)
+		if err != nil {
+			log.Errorln("cannot send settlement:", err)
+			wait = settlementRetryDelay
+		}
+		select {
+		case <-time.After(wait):
+		case <-settlementWakeC:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// settle sends the closed settlements and the open settlement if it is due.
+// Returns the duration until the open settlement is due.
+func settle(stop chan struct{}) (time.Duration, error) {
+	// Settlements that failed to send are retried first, oldest first.
+	// Settlements are sent in order and sending stops at the first failure,
+	// so settlements older than a sent one are also sent and listing stops there.
+	var sending []*Settlement
+	err := paymentStore.ListSettlements(0, func(r *store.Settlement) (bool, error) {
+		var st Settlement
+		if err := json.Unmarshal(r.Data, &st); err != nil {
+			return false, err
+		}
+		if st.Status == SettlementSent {
+			return false, nil
+		}
+		if st.Status == SettlementSending {
+			sending = append([]*Settlement{&st}, sending...)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	st, wait, err := closeSettlementIfDue()
+	if err != nil {
+		return 0, err
+	}
+	if st != nil {
+		sending = append(sending, st)
+	}
+	for _, st := range sending {
+		select {
+		case <-stop:
+			return wait, nil
+		default:
+		}
+		err = st.send(shutdownCtx)
+		if err != nil {
+			st.LastError = err.Error()
+			if err2 := st.Save(); err2 != nil {
+				log.Errorln("cannot save settlement:", err2)
+			}
+			return 0, err
+		}
+	}
+	return wait, nil
+}
+
+// closeSettlementIfDue closes the open settlement for new payments if it is due and returns it.
+// Returns the duration until the open settlement is due if it is not closed.
+func closeSettlementIfDue() (*Settlement, time.Duration, error) {
+	settlementMu.Lock()
+	defer settlementMu.Unlock()
+
+	st, err := loadOpenSettlement()
+	if err != nil || st == nil {
+		return nil, config.SettlementInterval, err
+	}
+	wait := time.Until(st.CreatedAt.Add(config.SettlementInterval))
+	reachedThreshold := config.SettlementThreshold.IsPositive() && st.Amount.GreaterThanOrEqual(units.NanoToRaw(config.SettlementThreshold))
+	if wait > 0 && !reachedThreshold {
+		return nil, wait, nil
+	}
+	st.Status = SettlementSending
+	st.ClosedAt = now()
+	return st, config.SettlementInterval, st.Save()
+}
+
+// send receives the collected payments in the settlement account and sends the total amount to the merchant account.
+// Progress is saved after each published block so that a failure in the middle does not cause double sends.
+// The send block to the merchant account is saved before it is published and checked in the ledger when retried.
+func (st *Settlement) send(ctx context.Context) error {
+	key, err := settlementKey()
+	if err != nil {
+		return err
+	}
+	err = st.reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range st.Payments {
+		sp := &st.Payments[i]
+		if sp.Received {
+			continue
+		}
+		err = receiveBlock(ctx, sp.Hash, sp.Amount, key.Account, key.Private, key.Public)
+		if err != nil {
+			return err
+		}
+		sp.Received = true
+		err = st.Save()
+		if err != nil {
+			return err
+		}
+	}
+	if st.Hash != "" {
+		published, err2 := node.BlockExists(ctx, st.Hash)
+		if err2 != nil {
+			return err2
+		}
+		if published {
+			log.Noticef("settlement %d is already sent with block %s", st.ID, st.Hash)
+			return st.markSent()
+		}
+	}
+	log.Noticef("sending settlement %d of %s NANO to %s", st.ID, units.RawToNano(st.Amount), config.Account)
+	info, err := node.AccountInfoContext(ctx, key.Account)
+	if err != nil {
+		return err
+	}
+	if info.Balance.LessThan(st.Amount) {
+		return errInsufficientBalance
+	}
+	block, hash, err := createSendBlock(ctx, info, key.Account, config.Account, key.Private, info.Balance.Sub(st.Amount))
+	if err != nil {
+		return err
+	}
+	st.Hash = hash
+	st.Account = config.Account
+	err = st.Save()
+	if err != nil {
+		return err
+	}
+	_, err = publishBlock(block)
+	if err != nil {
+		return err
+	}
+	log.Debugln("published new block:", hash)
+	return st.markSent()
+}
+
+// reconcile resolves the entries left in publishing state by collect and reloads the settlement.
+// Entries are resolved under the lock of their payment account so that they are not changed by collect at the same time.
+func (st *Settlement) reconcile(ctx context.Context) error {
+	var accounts []string
+	for _, sp := range st.Payments {
+		if sp.Publishing {
+			accounts = append(accounts, sp.Account)
+		}
+	}
+	if len(accounts) == 0 {
+		return nil
+	}
+	for _, account := range accounts {
+		locks.Lock(account)
+		err := reconcileSettledPayment(ctx, st.ID, account)
+		locks.Unlock(account)
+		if err != nil {
+			return err
+		}
+	}
+	st2, err := LoadSettlement(st.ID)
+	if err != nil {
+		return err
+	}
+	*st = *st2
+	return nil
+}
+
+func (st *Settlement) markSent() error {
+	st.Status = SettlementSent
+	st.SentAt = now()
+	st.LastError = ""
+	return st.Save()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+var errInvalidSplitRule = errors.New("invalid split rule")
+
+var oneHundred = decimal.NewFromInt(100)
+
+// SplitShare is the percentage of a payment that is sent to an account.
+type SplitShare struct {
+	Account string          `json:"account"`
+	Percent decimal.Decimal `json:"percent"`
+}
+
+// Payout is a send block from the payment account to one of the accounts in the split rule.
+type Payout struct {
+	// Hash of the send block.
+	Hash string `json:"hash"`
+	// Destination account.
+	Account string `json:"account"`
+	// Amount in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Set when the block is published.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// validateSplitRules checks that shares of every rule in SplitRules add up to 100 percent.
+func validateSplitRules(rules map[string][]SplitShare) error {
+	for name, shares := range rules {
+		if len(shares) == 0 {
+			return fmt.Errorf("split rule %q has no shares", name)
+		}
+		total := decimal.Zero
+		for _, share := range shares {
+			if share.Account == "" {
+				return fmt.Errorf("split rule %q has a share without account", name)
+			}
+			if !share.Percent.IsPositive() {
+				return fmt.Errorf("split rule %q has a non-positive share for %s", name, share.Account)
+			}
+			total = total.Add(share.Percent)
+		}
+		if !total.Equal(oneHundred) {
+			return fmt.Errorf("shares of split rule %q add up to %s percent instead of 100", name, total)
+		}
+	}
+	if config.DefaultSplitRule != "" {
+		if _, ok := rules[config.DefaultSplitRule]; !ok {
+			return fmt.Errorf("DefaultSplitRule %q is not in SplitRules", config.DefaultSplitRule)
+		}
+	}
+	return nil
+}
+
+// splitShares returns the shares of the named rule. DefaultSplitRule is used if name is empty.
+// Returns nil if there is no rule to apply.
+func splitShares(name string) ([]SplitShare, error) {
+	if name == "" {
+		name = config.DefaultSplitRule
+		if name == "" {
+			return nil, nil
+		}
+	}
+	shares, ok := config.SplitRules[name]
+	if !ok {
+		return nil, errInvalidSplitRule
+	}
+	return append([]SplitShare(nil), shares...), nil
+}
+
+// payoutLegs distributes total amount in raw to the accounts in shares.
+// Amounts are rounded down and the remainder is added to the last leg so that all of the total is paid out.
+func payoutLegs(shares []SplitShare, total decimal.Decimal) []Payout {
+	legs := make([]Payout, 0, len(shares))
+	remaining := total
+	for i, share := range shares {
+		amount := remaining
+		if i < len(shares)-1 {
+			amount = total.Mul(share.Percent).Div(oneHundred).Floor()
+		}
+		legs = append(legs, Payout{Account: share.Account, Amount: amount})
+		remaining = remaining.Sub(amount)
+	}
+	return legs
+}
+
+// remainingPayouts returns the legs that are not paid yet, given the balance left in the payment account and the payouts already sent.
+// Legs are calculated from the original total so that resuming after a partial send pays out the same amounts.
+func remainingPayouts(shares []SplitShare, balance decimal.Decimal, payouts []Payout) []Payout {
+	sent := make(map[string]decimal.Decimal)
+	total := balance
+	for _, payout := range payouts {
+		sent[payout.Account] = sent[payout.Account].Add(payout.Amount)
+		total = total.Add(payout.Amount)
+	}
+	var remaining []Payout
+	for _, leg := range payoutLegs(shares, total) {
+		amount := leg.Amount.Sub(sent[leg.Account])
+		sent[leg.Account] = decimal.Max(decimal.Zero, sent[leg.Account].Sub(leg.Amount))
+		if !amount.IsPositive() {
+			continue
+		}
+		leg.Amount = amount
+		remaining = append(remaining, leg)
+	}
+	return remaining
+}
+
+// sendPayouts sends the balance of the payment account to the accounts in the split rule of the payment.
+// Payouts are saved after each published block so that a failure in the middle does not cause double sends.
+// If it is called again after a failure, legs are calculated from the original total and only the remaining ones are sent.
+func (p *Payment) sendPayouts(ctx context.Context, privateKey string) error {
+	info, err := node.AccountInfoContext(ctx, p.account)
+	if err != nil {
+		return err
+	}
+	for _, leg := range remainingPayouts(p.Split, info.Balance, p.Payouts) {
+		log.Noticef("sending %s NANO from %s to %s", units.RawToNano(leg.Amount), p.account, leg.Account)
+		leg.Hash, err = sendAmount(ctx, p.account, leg.Account, privateKey, leg.Amount)
+		if err != nil {
+			return err
+		}
+		leg.CreatedAt = time.Now().UTC()
+		p.Payouts = append(p.Payouts, leg)
+		err = p.Save()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func share(account, percent string) SplitShare {
+	return SplitShare{Account: account, Percent: decimal.RequireFromString(percent)}
+}
+
+func payout(account, amount string) Payout {
+	return Payout{Account: account, Amount: decimal.RequireFromString(amount)}
+}
+
+func assertPayouts(t *testing.T, expected, actual []Payout) {
+	t.Helper()
+	if !assert.Len(t, actual, len(expected)) {
+		return
+	}
+	for i := range expected {
+		assert.Equal(t, expected[i].Account, actual[i].Account)
+		assert.True(t, expected[i].Amount.Equal(actual[i].Amount), "leg %d: expected %s, got %s", i, expected[i].Amount, actual[i].Amount)
+	}
+}
+
+func TestPayoutLegs(t *testing.T) {
+	cases := []struct {
+		name   string
+		shares []SplitShare
+		total  string
+		legs   []Payout
+	}{
+		{
+			name:   "single share",
+			shares: []SplitShare{share("a", "100")},
+			total:  "1000",
+			legs:   []Payout{payout("a", "1000")},
+		},
+		{
+			name:   "exact split",
+			shares: []SplitShare{share("a", "70"), share("b", "30")},
+			total:  "1000",
+			legs:   []Payout{payout("a", "700"), payout("b", "300")},
+		},
+		{
+			name:   "remainder goes to last leg",
+			shares: []SplitShare{share("a", "33.3"), share("b", "33.3"), share("c", "33.4")},
+			total:  "1001",
+			legs:   []Payout{payout("a", "333"), payout("b", "333"), payout("c", "335")},
+		},
+		{
+			name:   "amounts are rounded down",
+			shares: []SplitShare{share("a", "50"), share("b", "50")},
+			total:  "3",
+			legs:   []Payout{payout("a", "1"), payout("b", "2")},
+		},
+		{
+			name:   "dust",
+			shares: []SplitShare{share("a", "10"), share("b", "90")},
+			total:  "1",
+			legs:   []Payout{payout("a", "0"), payout("b", "1")},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assertPayouts(t, c.legs, payoutLegs(c.shares, decimal.RequireFromString(c.total)))
+		})
+	}
+}
+
+func TestRemainingPayouts(t *testing.T) {
+	shares := []SplitShare{share("a", "33.3"), share("b", "33.3"), share("c", "33.4")}
+	cases := []struct {
+		name      string
+		shares    []SplitShare
+		balance   string
+		payouts   []Payout
+		remaining []Payout
+	}{
+		{
+			name:      "nothing sent",
+			shares:    shares,
+			balance:   "1001",
+			remaining: []Payout{payout("a", "333"), payout("b", "333"), payout("c", "335")},
+		},
+		{
+			name:      "resume after first leg",
+			shares:    shares,
+			balance:   "668",
+			payouts:   []Payout{payout("a", "333")},
+			remaining: []Payout{payout("b", "333"), payout("c", "335")},
+		},
+		{
+			name:      "resume after two legs",
+			shares:    shares,
+			balance:   "335",
+			payouts:   []Payout{payout("a", "333"), payout("b", "333")},
+			remaining: []Payout{payout("c", "335")},
+		},
+		{
+			name:    "all sent",
+			shares:  shares,
+			balance: "0",
+			payouts: []Payout{payout("a", "333"), payout("b", "333"), payout("c", "335")},
+		},
+		{
+			name:      "funds arrived after partial send",
+			shares:    []SplitShare{share("a", "50"), share("b", "50")},
+			balance:   "600",
+			payouts:   []Payout{payout("a", "500")},
+			remaining: []Payout{payout("a", "50"), payout("b", "550")},
+		},
+		{
+			name:      "same account in multiple shares",
+			shares:    []SplitShare{share("a", "50"), share("a", "25"), share("b", "25")},
+			balance:   "500",
+			payouts:   []Payout{payout("a", "500")},
+			remaining: []Payout{payout("a", "250"), payout("b", "250")},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assertPayouts(t, c.remaining, remainingPayouts(c.shares, decimal.RequireFromString(c.balance), c.payouts))
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/cenkalti/log"
+)
+
+// Status is the state of the payment in its lifecycle.
+type Status string
+
+const (
+	// Payment is created and waiting for funds.
+	StatusPending Status = "pending"
+	// Some funds are sent to the payment account but they are not enough to fulfill the payment.
+	StatusPartiallyPaid Status = "partially_paid"
+	// Enough funds are sent to the payment account.
+	StatusFulfilled Status = "fulfilled"
+	// Merchant notification is queued for delivery.
+	StatusNotified Status = "notified"
+	// Pending funds are accepted to the payment account.
+	StatusReceived Status = "received"
+	// Funds are sent to the merchant account.
+	StatusSettled Status = "settled"
+	// Allowed duration is passed before the payment is fulfilled.
+	StatusExpired Status = "expired"
+	// Payment is cancelled before it is fulfilled.
+	StatusCancelled Status = "cancelled"
+	// Funds are sent to the payment account after the payment is expired or cancelled.
+	StatusLatePaid Status = "late_paid"
+)
+
+// statusTransitions contains the allowed next statuses for each status.
+var statusTransitions = map[Status][]Status{
+	StatusPending:       {StatusPartiallyPaid, StatusFulfilled, StatusExpired, StatusCancelled},
+	StatusPartiallyPaid: {StatusFulfilled, StatusExpired, StatusCancelled},
+	StatusFulfilled:     {StatusNotified},
+	StatusNotified:      {StatusReceived},
+	StatusReceived:      {StatusSettled},
+	// Expired payments can still be checked manually from admin endpoint.
+	StatusExpired: {StatusPartiallyPaid, StatusFulfilled, StatusLatePaid},
+	// Funds sent after cancellation are detected by late payment checker.
+	StatusCancelled: {StatusLatePaid},
+	// Merchant can accept the late payment by checking it manually from admin endpoint.
+	StatusLatePaid: {StatusFulfilled},
+}
+
+// final returns true if no more operations are going to be done automatically on the payment.
+func (s Status) final() bool {
+	switch s {
+	case StatusSettled, StatusExpired, StatusCancelled, StatusLatePaid:
+		return true
+	}
+	return false
+}
+
+// refundable returns true if funds in the payment account can be refunded to the customers.
+// In-flight payments are not refundable because their funds are going to be sent to the merchant.
+// Settled payments can be refunded only if there are leftover funds in the payment account.
+func (s Status) refundable() bool {
+	switch s {
+	case StatusSettled, StatusExpired, StatusCancelled, StatusLatePaid:
+		return true
+	}
+	return false
+}
+
+func (s Status) canTransition(next Status) bool {
+	for _, t := range statusTransitions[s] {
+		if t == next {
+			return true
+		}
+	}
+	return false
+}
+
+// setStatus validates and sets the status of the payment.
+// Setting the current status again is allowed and does nothing.
+func (p *Payment) setStatus(next Status) error {
+	if p.Status == next {
+		return nil
+	}
+	if !p.Status.canTransition(next) {
+		return fmt.Errorf("invalid status transition: %s -> %s", p.Status, next)
+	}
+	log.Debugf("payment %s status: %s -> %s", p.account, p.Status, next)
+	p.Status = next
+	return nil
+}
+
+// deriveStatus returns the status of payments saved before Status field is introduced.
+func (p *Payment) deriveStatus() Status {
+	switch {
+	case p.SentAt != nil:
+		return StatusSettled
+	case p.ReceivedAt != nil:
+		return StatusReceived
+	case p.NotifiedAt != nil:
+		return StatusNotified
+	case p.FulfilledAt != nil:
+		return StatusFulfilled
+	case p.LatePaidAt != nil:
+		return StatusLatePaid
+	case p.CancelledAt != nil:
+		return StatusCancelled
+	case p.ExpiredAt != nil:
+		return StatusExpired
+	case p.Balance.IsPositive():
+		return StatusPartiallyPaid
+	default:
+		return StatusPending
+	}
+}
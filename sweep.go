@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/nano"
+	"github.com/accept-nano/accept-nano/internal/store"
+	"github.com/accept-nano/accept-nano/internal/units"
+	"github.com/cenkalti/log"
+	"github.com/shopspring/decimal"
+)
+
+// Max number of pending blocks received from a deposit account in a single sweep.
+const sweepPendingCount = 100
+
+// SweepReport contains the funds found in deposit accounts by a sweep. Amounts are in NANO.
+type SweepReport struct {
+	// Blocks are not published if set.
+	DryRun bool `json:"dryRun"`
+	// Number of deposit accounts checked.
+	Checked int `json:"checked"`
+	// Deposit accounts with funds.
+	Accounts []SweptAccount `json:"accounts"`
+	// Sum of pending amounts in all accounts, including the amounts below ReceiveThreshold but not below SweepThreshold.
+	TotalPending decimal.Decimal `json:"totalPending"`
+	// Sum of balances in all accounts.
+	TotalBalance decimal.Decimal `json:"totalBalance"`
+	// Amount sent to the merchant account. Zero for dry runs.
+	TotalSent decimal.Decimal `json:"totalSent"`
+	// Number of accounts that could not be swept.
+	Errors int `json:"errors"`
+}
+
+// SweptAccount contains the funds found in a single deposit account.
+type SweptAccount struct {
+	Account string          `json:"account"`
+	Index   string          `json:"index"`
+	Pending decimal.Decimal `json:"pending"`
+	Balance decimal.Decimal `json:"balance"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Sweep is a send block from a finished payment account to the merchant account.
+type Sweep struct {
+	// Hash of the send block.
+	Hash string `json:"hash"`
+	// Amount in raw.
+	Amount decimal.Decimal `json:"amount"`
+	// Set when the block is published.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// sweepable returns true if funds in the payment account are not going to be handled by the payment lifecycle.
+// Late paid payments are skipped because they wait for the merchant's action.
+func (p *Payment) sweepable() bool {
+	switch p.Status {
+	case StatusSettled:
+		return true
+	case StatusExpired, StatusCancelled:
+		// Funds sent within this period are detected by the late payment checker.
+		return time.Since(p.CreatedAt) > config.LatePaymentCheckPeriod
+	}
+	return false
+}
+
+// runSweeper sweeps deposit accounts periodically until stop is closed.
+func runSweeper(stop chan struct{}) {
+	defer workersWG.Done()
+	for {
+		select {
+		case <-time.After(config.SweepInterval):
+			report, err := sweepDepositAccounts(stop, false, config.SweepMaxAge)
+			if err != nil {
+				log.Errorln("cannot sweep deposit accounts:", err)
+				continue
+			}
+			if report.TotalSent.IsPositive() || report.Errors > 0 {
+				log.Noticef("swept %s NANO from %d deposit accounts, %d errors", report.TotalSent, len(report.Accounts), report.Errors)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweepDepositAccounts receives pending funds in finished payment accounts and sends the balances to the merchant account.
+// Only payments created within maxAge are checked unless it is zero.
+// If dryRun is set, only the funds are reported and no block is published.
+func sweepDepositAccounts(stop chan struct{}, dryRun bool, maxAge time.Duration) (*SweepReport, error) {
+	var payments []*Payment
+	var opts store.ListOptions
+	if maxAge > 0 {
+		opts.CreatedFrom = time.Now().Add(-maxAge)
+	}
+	err := paymentStore.List(opts, func(r *store.Record) (bool, error) {
+		p, err := decodePayment(r.Account, r.Data)
+		if err != nil {
+			log.Errorf("cannot decode payment %s: %s", r.Account, err)
+			return true, nil
+		}
+		if p.sweepable() {
+			payments = append(payments, p)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &SweepReport{DryRun: dryRun, Accounts: make([]SweptAccount, 0)}
+	for _, p := range payments {
+		select {
+		case <-stop:
+			return report, nil
+		default:
+		}
+		report.Checked++
+		swept, err := p.sweep(shutdownCtx, dryRun)
+		if err != nil {
+			log.Errorf("cannot sweep %s: %s", p.account, err)
+			swept.Error = err.Error()
+			report.Errors++
+		}
+		if swept.Pending.IsZero() && swept.Balance.IsZero() && swept.Error == "" {
+			continue
+		}
+		report.TotalPending = report.TotalPending.Add(swept.Pending)
+		report.TotalBalance = report.TotalBalance.Add(swept.Balance)
+		report.Accounts = append(report.Accounts, swept)
+	}
+	report.TotalPending = units.RawToNano(report.TotalPending)
+	report.TotalBalance = units.RawToNano(report.TotalBalance)
+	for i := range report.Accounts {
+		a := &report.Accounts[i]
+		if !dryRun && a.Error == "" {
+			report.TotalSent = report.TotalSent.Add(a.Pending).Add(a.Balance)
+		}
+		a.Pending = units.RawToNano(a.Pending)
+		a.Balance = units.RawToNano(a.Balance)
+	}
+	report.TotalSent = units.RawToNano(report.TotalSent)
+	return report, nil
+}
+
+// sweep receives the pending blocks in the payment account and sends all of the balance to the merchant account.
+// If the payment has a split rule, the balance is sent to the accounts in the rule instead.
+// Send blocks are recorded in Sweeps, or in Payouts for split payments.
+// Amounts in the returned value are in raw.
+func (p *Payment) sweep(ctx context.Context, dryRun bool) (SweptAccount, error) {
+	locks.Lock(p.account)
+	defer locks.Unlock(p.account)
+
+	ret := SweptAccount{Account: p.account, Index: p.Index}
+	err := p.reload()
+	if err != nil {
+		return ret, err
+	}
+	if !p.sweepable() {
+		return ret, nil
+	}
+	pendingBlocks, err := node.PendingContext(ctx, p.account, sweepPendingCount, units.NanoToRaw(config.SweepThreshold))
+	if err != nil {
+		return ret, err
+	}
+	for _, b := range pendingBlocks {
+		ret.Pending = ret.Pending.Add(b.Amount)
+	}
+	info, err := node.AccountInfoContext(ctx, p.account)
+	switch err {
+	case nil:
+		ret.Balance = info.Balance
+	case nano.ErrAccountNotFound:
+	default:
+		return ret, err
+	}
+	if dryRun || (ret.Pending.IsZero() && ret.Balance.IsZero()) {
+		return ret, nil
+	}
+	log.Noticef("sweeping %s NANO from %s", units.RawToNano(ret.Pending.Add(ret.Balance)), p.account)
+	key, err := node.DeterministicKey(config.Seed, p.Index)
+	if err != nil {
+		return ret, err
+	}
+	for hash, b := range pendingBlocks {
+		err = receiveBlock(ctx, hash, b.Amount, p.account, key.Private, key.Public)
+		if err != nil {
+			return ret, err
+		}
+	}
+	if len(p.Split) > 0 {
+		return ret, p.sendPayouts(ctx, key.Private)
+	}
+	info, err = node.AccountInfoContext(ctx, p.account)
+	if err != nil {
+		return ret, err
+	}
+	if info.Balance.IsZero() {
+		return ret, nil
+	}
+	hash, err := sendBlock(ctx, info, p.account, config.Account, key.Private, decimal.Zero)
+	if err != nil {
+		return ret, err
+	}
+	p.Sweeps = append(p.Sweeps, Sweep{Hash: hash, Amount: info.Balance, CreatedAt: time.Now().UTC()})
+	return ret, p.Save()
+}
@@ -0,0 +1,114 @@
+// Package webhook contains helpers for signing and verifying the notifications
+// sent by accept-nano to merchant endpoints.
+//
+// A merchant backend written in Go can verify an incoming notification with:
+//
+//	body, err := webhook.VerifyRequest(r, []byte(secret), webhook.DefaultTolerance)
+//	if err != nil {
+//		http.Error(w, err.Error(), http.StatusUnauthorized)
+//		return
+//	}
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader is the HTTP header that carries the signature of the notification body.
+const SignatureHeader = "X-AcceptNano-Signature"
+
+// DefaultTolerance is the recommended maximum age of a notification to protect against replay attacks.
+const DefaultTolerance = 5 * time.Minute
+
+const signatureVersion = "v1"
+
+var (
+	ErrNoSignature       = errors.New("webhook: missing signature header")
+	ErrInvalidHeader     = errors.New("webhook: invalid signature header")
+	ErrSignatureMismatch = errors.New("webhook: signature mismatch")
+	ErrTimestampExpired  = errors.New("webhook: timestamp outside of tolerance")
+)
+
+// Sign returns the value of SignatureHeader for body sent at timestamp.
+// The header has the form "t=<unix timestamp>,v1=<hex encoded HMAC-SHA256>".
+// HMAC is calculated over "<unix timestamp>.<body>".
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + "," + signatureVersion + "=" + hex.EncodeToString(computeMAC(secret, t, body))
+}
+
+// Verify checks that header is a valid signature of body.
+// If tolerance is not zero, signatures older than tolerance are rejected.
+func Verify(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	if header == "" {
+		return ErrNoSignature
+	}
+	var t string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrInvalidHeader
+		}
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case signatureVersion:
+			sig, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return ErrInvalidHeader
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	if t == "" || len(signatures) == 0 {
+		return ErrInvalidHeader
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return ErrInvalidHeader
+	}
+	if tolerance != 0 {
+		age := time.Since(time.Unix(unix, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrTimestampExpired
+		}
+	}
+	expected := computeMAC(secret, t, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrSignatureMismatch
+}
+
+// VerifyRequest reads the body of r and verifies it against the signature in SignatureHeader.
+// The body is returned for decoding if the signature is valid.
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = Verify(secret, r.Header.Get(SignatureHeader), body, tolerance)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func computeMAC(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp)) // nolint:errcheck
+	mac.Write([]byte("."))       // nolint:errcheck
+	mac.Write(body)              // nolint:errcheck
+	return mac.Sum(nil)
+}
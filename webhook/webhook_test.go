@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSecret = []byte("s3cr3t")
+	testBody   = []byte(`{"account":"nano_1","fulfilled":true}`)
+)
+
+func TestSign(t *testing.T) {
+	header := Sign(testSecret, time.Unix(1600000000, 0), testBody)
+	assert.Equal(t, "t=1600000000,v1=", header[:16])
+	assert.Len(t, header, 16+64)
+}
+
+func TestVerify(t *testing.T) {
+	header := Sign(testSecret, time.Now(), testBody)
+	assert.NoError(t, Verify(testSecret, header, testBody, DefaultTolerance))
+	assert.Equal(t, ErrSignatureMismatch, Verify([]byte("other"), header, testBody, DefaultTolerance))
+	assert.Equal(t, ErrSignatureMismatch, Verify(testSecret, header, []byte(`{"fulfilled":false}`), DefaultTolerance))
+	assert.Equal(t, ErrNoSignature, Verify(testSecret, "", testBody, DefaultTolerance))
+	assert.Equal(t, ErrInvalidHeader, Verify(testSecret, "garbage", testBody, DefaultTolerance))
+	assert.Equal(t, ErrInvalidHeader, Verify(testSecret, "t=1,v1=zz", testBody, DefaultTolerance))
+}
+
+func TestVerifyTolerance(t *testing.T) {
+	header := Sign(testSecret, time.Now().Add(-time.Hour), testBody)
+	assert.Equal(t, ErrTimestampExpired, Verify(testSecret, header, testBody, DefaultTolerance))
+	assert.NoError(t, Verify(testSecret, header, testBody, 0))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost, "http://localhost/", bytes.NewReader(testBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(SignatureHeader, Sign(testSecret, time.Now(), testBody))
+	body, err := VerifyRequest(r, testSecret, DefaultTolerance)
+	assert.NoError(t, err)
+	assert.Equal(t, testBody, body)
+}
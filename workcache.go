@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/accept-nano/accept-nano/internal/nano"
+	"github.com/cenkalti/log"
+	"go.etcd.io/bbolt"
+)
+
+// Unused work is deleted from the cache after this duration.
+const workCacheMaxAge = 30 * 24 * time.Hour
+
+// Max number of hashes waiting for work to be precomputed. New requests are dropped when the queue is full.
+const workPrecomputeQueueSize = 1000
+
+// CachedWork is the work precomputed for the next block of an account.
+// Works are stored in the database in JSON format, keyed by the hash that the work is generated for.
+type CachedWork struct {
+	Work string `json:"work"`
+	// Work meets the threshold of send blocks. Such work can also be used for receive blocks.
+	ForSend   bool      `json:"forSend"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type workRequest struct {
+	hash    string
+	forSend bool
+}
+
+var workPrecomputeC = make(chan workRequest, workPrecomputeQueueSize)
+
+// Hashes waiting in the queue and hashes that the work is being precomputed for.
+// Channels in workInFlight are closed when the work is cached.
+var (
+	workQueued    = make(map[string]struct{})
+	workInFlight  = make(map[string]chan struct{})
+	workInFlightM sync.Mutex
+)
+
+// precomputeWork queues the hash for generating work in background.
+func precomputeWork(hash string, forSend bool) {
+	workInFlightM.Lock()
+	defer workInFlightM.Unlock()
+	if _, ok := workQueued[hash]; ok {
+		return
+	}
+	if _, ok := workInFlight[hash]; ok {
+		return
+	}
+	select {
+	case workPrecomputeC <- workRequest{hash, forSend}:
+		workQueued[hash] = struct{}{}
+	default:
+		log.Debugln("work precompute queue is full, dropping:", hash)
+	}
+}
+
+// runWorkPrecomputer generates work for queued hashes and saves them to the cache.
+// Old works are deleted from the cache periodically.
+func runWorkPrecomputer() {
+	defer workersWG.Done()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+	for {
+		select {
+		case req := <-workPrecomputeC:
+			err := precompute(req)
+			if err != nil {
+				log.Errorf("cannot precompute work for %s: %s", req.hash, err)
+			}
+		case <-cleanup.C:
+			err := deleteOldWork()
+			if err != nil {
+				log.Errorln("cannot delete old work from cache:", err)
+			}
+		case <-stopCheckPayments:
+			return
+		}
+	}
+}
+
+func precompute(req workRequest) error {
+	workInFlightM.Lock()
+	if _, ok := workQueued[req.hash]; !ok {
+		// Work is already generated by the caller that needed it.
+		workInFlightM.Unlock()
+		return nil
+	}
+	delete(workQueued, req.hash)
+	done := make(chan struct{})
+	workInFlight[req.hash] = done
+	workInFlightM.Unlock()
+	defer func() {
+		workInFlightM.Lock()
+		delete(workInFlight, req.hash)
+		close(done)
+		workInFlightM.Unlock()
+	}()
+	if _, ok := loadCachedWork(req.hash, req.forSend, false); ok {
+		return nil
+	}
+	work, err := workProvider.GenerateWork(shutdownCtx, req.hash, req.forSend)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(CachedWork{Work: work, ForSend: req.forSend, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	log.Debugln("work is cached for", req.hash)
+	return db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(workCacheBucket)).Put([]byte(req.hash), value)
+	})
+}
+
+// waitWorkInFlight waits until the work for hash is precomputed if it is in progress.
+// If the hash is still waiting in the queue, it is removed from the queue because the caller is going to generate the work itself.
+func waitWorkInFlight(ctx context.Context, hash string) {
+	workInFlightM.Lock()
+	delete(workQueued, hash)
+	c, ok := workInFlight[hash]
+	workInFlightM.Unlock()
+	if !ok {
+		return
+	}
+	log.Debugln("waiting for precomputed work:", hash)
+	select {
+	case <-c:
+	case <-ctx.Done():
+	}
+}
+
+// loadCachedWork returns the cached work for hash if it meets the threshold.
+// Work is deleted from the cache if remove is set because a hash is used for a single block.
+func loadCachedWork(hash string, forSend bool, remove bool) (string, bool) {
+	var cw *CachedWork
+	update := db.View
+	if remove {
+		update = db.Update
+	}
+	err := update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(workCacheBucket))
+		value := b.Get([]byte(hash))
+		if value == nil {
+			return nil
+		}
+		cw = new(CachedWork)
+		err := json.Unmarshal(value, cw)
+		if err != nil {
+			return err
+		}
+		if forSend && !cw.ForSend {
+			// Work for receive threshold is not enough for a send block. Keep it for a receive block.
+			cw = nil
+			return nil
+		}
+		if remove {
+			return b.Delete([]byte(hash))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorln("cannot load work from cache:", err)
+		return "", false
+	}
+	if cw == nil {
+		return "", false
+	}
+	if err = nano.ValidateWork(hash, cw.Work, forSend); err != nil {
+		log.Warningf("invalid work in cache for %s: %s", hash, err)
+		return "", false
+	}
+	return cw.Work, true
+}
+
+func deleteOldWork() error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(workCacheBucket))
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var cw CachedWork
+			if json.Unmarshal(v, &cw) != nil || time.Since(cw.CreatedAt) > workCacheMaxAge {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}